@@ -1,6 +1,6 @@
 /*
     #Description: Template query. Returns param: input parameter.##
-    #In: param = an input parameter;##
+    #In: param text required = an input parameter;##
     #Out: param = value of input parameter;##
     #Test: param = hello world!;##
     #Testpass: onerowonly##
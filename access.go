@@ -0,0 +1,150 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+var errAccessDenied = errors.New("Access denied")
+var errAccessParse = errors.New("Can't parse access")
+
+type accessMode int
+
+const (
+	accessDefault       accessMode = iota // authenticated if login is required, else public
+	accessPublic                          // no session needed
+	accessAuthenticated                   // any session
+	accessRules                           // session data must match any of rules
+)
+
+// access rule, role or claim=value
+type accessRule struct {
+	claim string // empty claim is a role
+	value string
+}
+
+func (r accessRule) String() string {
+	if r.claim == "" {
+		return r.value
+	}
+	return r.claim + "=" + r.value
+}
+
+// query access rules
+type queryAccess struct {
+	mode  accessMode
+	rules []accessRule
+}
+
+func (a queryAccess) String() string {
+	switch a.mode {
+	case accessPublic:
+		return "public"
+	case accessAuthenticated:
+		return "authenticated"
+	case accessRules:
+		if len(a.rules) == 0 {
+			return "nobody"
+		}
+		rules := make([]string, len(a.rules))
+		for i, rule := range a.rules {
+			rules[i] = rule.String()
+		}
+		return strings.Join(rules, ", ")
+	}
+	return "default"
+}
+
+// parse access directive: public, authenticated or comma separated list of roles and claim=value rules
+func (a *queryAccess) parse(str string) error {
+	var res queryAccess
+	for _, item := range strings.Split(str, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+
+		switch strings.ToLower(item) {
+		case "public":
+			res.mode = accessPublic
+			continue
+		case "authenticated":
+			res.mode = accessAuthenticated
+			continue
+		}
+
+		var rule accessRule
+		if i := strings.Index(item, "="); i >= 0 {
+			rule.claim = strings.ToLower(strings.TrimSpace(item[:i]))
+			rule.value = strings.TrimSpace(item[i+1:])
+			if rule.claim == "" {
+				return fmt.Errorf("empty claim name: %s", item)
+			}
+		} else {
+			rule.value = item
+		}
+		res.rules = append(res.rules, rule)
+	}
+
+	switch {
+	case res.mode == accessDefault && len(res.rules) == 0:
+		return errors.New("empty access rules")
+	case res.mode != accessDefault && len(res.rules) > 0:
+		return errors.New("public and authenticated can't be combined with roles or claims")
+	case len(res.rules) > 0:
+		res.mode = accessRules
+	}
+
+	*a = res
+	return nil
+}
+
+// session data matches any of rules, roles are values of role column
+func (a queryAccess) allowed(data queryParams, roleColumn string) bool {
+	for _, rule := range a.rules {
+		claim := rule.claim
+		if claim == "" {
+			claim = roleColumn
+		}
+
+		if accessValueMatch(sessionValue(data, claim), rule.value) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// session value by case insensitive column name
+func sessionValue(data queryParams, column string) interface{} {
+	if val, ok := data[column]; ok {
+		return val
+	}
+
+	for key, val := range data {
+		if strings.EqualFold(key, column) {
+			return val
+		}
+	}
+	return nil
+}
+
+// value or any element of array value is equal to rule value
+func accessValueMatch(val interface{}, expected string) bool {
+	if list, ok := val.([]interface{}); ok {
+		for _, elem := range list {
+			if accessValueMatch(elem, expected) {
+				return true
+			}
+		}
+		return false
+	}
+
+	if val == nil {
+		return false
+	}
+
+	str, err := jsonValueString(val)
+	return err == nil && str == expected
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v4"
+	"github.com/jackc/pgx/v4/pgxpool"
+)
+
+var errAPIKeyInvalid = errors.New("API key is invalid or expired")
+
+// API key of machine client
+type apiKey struct {
+	Hash   string      `json:"hash"`   // sha256 hex of key
+	Label  string      `json:"label"`  // key name in logs
+	Scopes []string    `json:"scopes"` // query paths or directories, empty is any query
+	Expire *time.Time  `json:"expire"` // nil is never
+	Data   queryParams `json:"data"`   // session data of key, passed to queries as reserved params
+}
+
+// key can call query, scope matches whole path segments
+func (k *apiKey) allowed(queryname string) bool {
+	if len(k.Scopes) == 0 {
+		return true
+	}
+
+	for _, scope := range k.Scopes {
+		if queryname == scope || strings.HasPrefix(queryname, strings.TrimSuffix(scope, "/")+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+func (k *apiKey) expired() bool {
+	return k.Expire != nil && time.Now().After(*k.Expire)
+}
+
+// API keys storage, keys are looked up by hash
+type apiKeyStore interface {
+	get(ctx context.Context, hash string) (*apiKey, error) // nil if key is not found
+}
+
+var errAPIKeyStore = errors.New("Unknown API key store")
+
+// create API key store by name: file or postgres
+func apiKeyStoreNew(ctx context.Context, name string, pool *pgxpool.Pool, file string, table string) (apiKeyStore, error) {
+	switch strings.ToLower(name) {
+	case "file":
+		return apiKeyFileStoreNew(file)
+	case "postgres":
+		return apiKeyPgStoreNew(ctx, pool, table)
+	}
+
+	return nil, fmt.Errorf("%w: %s", errAPIKeyStore, name)
+}
+
+// hash of API key
+func apiKeyHash(key string) string {
+	hash := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(hash[:])
+}
+
+// new random API key and its hash
+func apiKeyGenerate() (string, string, error) {
+	bin := make([]byte, 32)
+	if _, err := rand.Read(bin); err != nil {
+		return "", "", err
+	}
+
+	key := base64.RawURLEncoding.EncodeToString(bin)
+	return key, apiKeyHash(key), nil
+}
+
+// json file with array of keys, loaded on start
+type apiKeyFileStore struct {
+	keys map[string]*apiKey
+}
+
+func apiKeyFileStoreNew(file string) (*apiKeyFileStore, error) {
+	bin, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	var keys []*apiKey
+	dec := json.NewDecoder(bytes.NewReader(bin))
+	dec.UseNumber()
+	if err := dec.Decode(&keys); err != nil {
+		return nil, fmt.Errorf("%s: %w", file, err)
+	}
+
+	s := apiKeyFileStore{keys: make(map[string]*apiKey, len(keys))}
+	for _, key := range keys {
+		s.keys[strings.ToLower(key.Hash)] = key
+	}
+
+	return &s, nil
+}
+
+func (s *apiKeyFileStore) get(ctx context.Context, hash string) (*apiKey, error) {
+	return s.keys[hash], nil
+}
+
+// postgres table of keys, shared by all service instances
+type apiKeyPgStore struct {
+	pool  *pgxpool.Pool
+	table string // sanitized table name
+}
+
+func apiKeyPgStoreNew(ctx context.Context, pool *pgxpool.Pool, table string) (*apiKeyPgStore, error) {
+	s := apiKeyPgStore{
+		pool:  pool,
+		table: pgx.Identifier(strings.Split(table, ".")).Sanitize(),
+	}
+
+	if _, err := pool.Exec(ctx, "create table if not exists "+s.table+
+		" (hash text primary key, label text not null, scopes text[], expire timestamptz, data jsonb)"); err != nil {
+		return nil, err
+	}
+
+	return &s, nil
+}
+
+func (s *apiKeyPgStore) get(ctx context.Context, hash string) (*apiKey, error) {
+	key := apiKey{Hash: hash}
+	var data *string
+	err := s.pool.QueryRow(ctx, "select label, coalesce(scopes, '{}'), expire, data::text from "+s.table+" where hash = $1", hash).
+		Scan(&key.Label, &key.Scopes, &key.Expire, &data)
+	if err == pgx.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if data != nil {
+		if key.Data, err = sessionDataDecode([]byte(*data)); err != nil {
+			return nil, err
+		}
+	}
+
+	return &key, nil
+}
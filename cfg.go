@@ -1,6 +1,7 @@
 package main
 
 import (
+	"fmt"
 	"log"
 	"time"
 
@@ -16,21 +17,72 @@ func cfgNew(cfgFile string) (*viper.Viper, error) {
 	vpr.SetDefault("sqlroot", "/path/to/sql/files")
 	vpr.SetDefault("keepalive", false)
 	vpr.SetDefault("querytimeout", (time.Second * 60))
+	vpr.SetDefault("statementtimeout", false)
+	vpr.SetDefault("streamresults", false)
+	vpr.SetDefault("txretries", 3)
+	vpr.SetDefault("txretrydelay", (time.Millisecond * 50))
 	vpr.SetDefault("autotest", false)
 	vpr.SetDefault("testworkers", 1)
 	vpr.SetDefault("ignorerrors", false)
 	vpr.SetDefault("mutedberrors", true)
+	vpr.SetDefault("sqlstatehttpprefix", "PM")
 	vpr.SetDefault("usetls", true)
 	vpr.SetDefault("certfile", "certfile.crt")
 	vpr.SetDefault("keyfile", "keyfile.key")
+	vpr.SetDefault("clientca", "")
+	vpr.SetDefault("clientauth", "optional")
+	vpr.SetDefault("clientidentity", "cn")
 	vpr.SetDefault("filteroutparams", true)
 	vpr.SetDefault("filterinparams", true)
 	vpr.SetDefault("loginrequired", true)
 	vpr.SetDefault("sessionlifetime", (time.Second * 300))
+	vpr.SetDefault("sessionsliding", false)
+	vpr.SetDefault("sessionmaxlifetime", time.Duration(0))
 	vpr.SetDefault("loginquery", "/login")
+	vpr.SetDefault("loginattempts", 0)
+	vpr.SetDefault("loginbackoff", time.Second)
+	vpr.SetDefault("loginmaxbackoff", (time.Minute * 15))
+	vpr.SetDefault("loginattemptswindow", (time.Minute * 15))
+	vpr.SetDefault("loginparam", "login")
 	vpr.SetDefault("cookiesession", true)
+	vpr.SetDefault("cookiesamesite", "lax")
+	vpr.SetDefault("csrfprotection", true)
+	vpr.SetDefault("csrfsecret", "")
+	vpr.SetDefault("sessiontype", "uuid")
+	vpr.SetDefault("jwtkid", "")
+	vpr.SetDefault("jwtdenylist", false)
+	vpr.SetDefault("sessionstore", "memory")
+	vpr.SetDefault("sessiontable", "pgmusql_sessions")
+	vpr.SetDefault("sessiondir", "sessions")
 	vpr.SetDefault("logoutquery", "")
+	vpr.SetDefault("sessionrole", "")
+	vpr.SetDefault("accessrolecolumn", "role")
 	vpr.SetDefault("docenable", true)
+	vpr.SetDefault("apikeystore", "")
+	vpr.SetDefault("apikeyheader", "X-API-Key")
+	vpr.SetDefault("apikeyfile", "apikeys.json")
+	vpr.SetDefault("apikeytable", "pgmusql_apikeys")
+	vpr.SetDefault("ratelimit", 0)
+	vpr.SetDefault("rateburst", 0)
+	vpr.SetDefault("maxconcurrent", 0)
+	vpr.SetDefault("limitkey", "session")
+	vpr.SetDefault("adminenable", false)
+	vpr.SetDefault("adminaccess", "admin")
+	vpr.SetDefault("hotreload", false)
+	vpr.SetDefault("hotreloaddelay", (time.Millisecond * 500))
+	vpr.SetDefault("hotreloadtest", false)
+	vpr.SetDefault("dbmaxconns", 0)
+	vpr.SetDefault("dbminconns", 0)
+	vpr.SetDefault("dbmaxconnidletime", 0)
+	vpr.SetDefault("dbmaxconnlifetime", 0)
+	vpr.SetDefault("dbhealthcheckperiod", 0)
+	vpr.SetDefault("dbapplicationname", "pgmusql")
+	vpr.SetDefault("dbafterconnect", "")
+	vpr.SetDefault("dbconnectretries", 5)
+	vpr.SetDefault("dbconnectretrydelay", time.Second)
+	vpr.SetDefault("replicaselect", false)
+	vpr.SetDefault("replicamaxlag", (time.Second * 10))
+	vpr.SetDefault("replicacheckperiod", (time.Second * 5))
 
 	// load from file
 	log.Printf("Load config from %s\n", cfgFile)
@@ -51,3 +103,21 @@ func cfgPrint(cfg *viper.Viper) {
 	}
 	log.Println("---CONFIG END---")
 }
+
+// settings as flat key-value list, table keys are prefixed by table name
+func cfgFlatten(cfg *viper.Viper) map[string]string {
+	res := make(map[string]string)
+	var flatten func(prefix string, settings map[string]interface{})
+	flatten = func(prefix string, settings map[string]interface{}) {
+		for key, val := range settings {
+			if table, ok := val.(map[string]interface{}); ok {
+				flatten(prefix+key+".", table)
+				continue
+			}
+			res[prefix+key] = fmt.Sprint(val)
+		}
+	}
+	flatten("", cfg.AllSettings())
+
+	return res
+}
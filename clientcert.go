@@ -0,0 +1,75 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"strings"
+)
+
+var errClientAuth = errors.New("Invalid clientauth value")
+var errClientCA = errors.New("No certificates found in client CA bundle")
+
+// TLS config with client certificate verification, mode is required or optional
+func tlsClientConfig(caFile string, mode string) (*tls.Config, error) {
+	var auth tls.ClientAuthType
+	switch strings.ToLower(mode) {
+	case "required":
+		auth = tls.RequireAndVerifyClientCert
+	case "optional":
+		auth = tls.VerifyClientCertIfGiven
+	default:
+		return nil, fmt.Errorf("%w: %s", errClientAuth, mode)
+	}
+
+	bin, err := ioutil.ReadFile(caFile)
+	if err != nil {
+		return nil, err
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(bin) {
+		return nil, fmt.Errorf("%w: %s", errClientCA, caFile)
+	}
+
+	return &tls.Config{ClientCAs: pool, ClientAuth: auth}, nil
+}
+
+// session data of client certificate: subject, common name and SANs.
+// Identity field value (cn, dns, email or uri, the first SAN is used) is also the identity column.
+func certIdentity(cert *x509.Certificate, field string) queryParams {
+	uris := make([]interface{}, 0, len(cert.URIs))
+	for _, uri := range cert.URIs {
+		uris = append(uris, uri.String())
+	}
+
+	data := queryParams{
+		"subject": cert.Subject.String(),
+		"cn":      cert.Subject.CommonName,
+		"dns":     stringsToValues(cert.DNSNames),
+		"email":   stringsToValues(cert.EmailAddresses),
+		"uri":     uris,
+	}
+
+	switch val := data[strings.ToLower(field)].(type) {
+	case string:
+		data["identity"] = val
+	case []interface{}:
+		if len(val) > 0 {
+			data["identity"] = val[0]
+		}
+	}
+
+	return data
+}
+
+// strings as json array value
+func stringsToValues(list []string) []interface{} {
+	res := make([]interface{}, len(list))
+	for i, str := range list {
+		res[i] = str
+	}
+	return res
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"strings"
+)
+
+const (
+	csrfCookieName = "Csrf-Token"
+	csrfHeaderName = "X-CSRF-Token"
+)
+
+var errCSRFToken = errors.New("CSRF token is missing or invalid")
+var errCSRFSecret = errors.New("csrfsecret is required if sessions outlive the process (jwt sessions, postgres or file session store)")
+
+// CSRF protection of cookie sessions.
+// Token is a HMAC of session key, it is sent in not HttpOnly cookie and the client returns it in the header.
+type csrfGuard struct {
+	secret []byte
+}
+
+// random secret is used if secret is empty, then tokens are valid in this process only.
+// Sessions that survive restart or are shared by instances need a configured secret.
+func csrfGuardNew(secret string, persistentSessions bool) (*csrfGuard, error) {
+	g := csrfGuard{secret: []byte(secret)}
+	if len(g.secret) == 0 {
+		if persistentSessions {
+			return nil, errCSRFSecret
+		}
+
+		g.secret = make([]byte, 32)
+		if _, err := rand.Read(g.secret); err != nil {
+			return nil, err
+		}
+	}
+
+	return &g, nil
+}
+
+// token of session key
+func (g *csrfGuard) token(authkey string) string {
+	mac := hmac.New(sha256.New, g.secret)
+	mac.Write([]byte(authkey))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// request header must contain token of session key
+func (g *csrfGuard) check(req *http.Request, authkey string) error {
+	token := req.Header.Get(csrfHeaderName)
+	if token == "" || !hmac.Equal([]byte(token), []byte(g.token(authkey))) {
+		return errCSRFToken
+	}
+	return nil
+}
+
+// send token in cookie and header
+func (g *csrfGuard) set(rw http.ResponseWriter, authkey string, cookie http.Cookie) {
+	token := g.token(authkey)
+	cookie.Name = csrfCookieName
+	cookie.Value = token
+	cookie.HttpOnly = false
+
+	http.SetCookie(rw, &cookie)
+	rw.Header().Set(csrfHeaderName, token)
+}
+
+// SameSite cookie attribute by name: lax, strict, none or default (attribute is not set)
+func cookieSameSite(name string) (http.SameSite, error) {
+	switch strings.ToLower(name) {
+	case "lax":
+		return http.SameSiteLaxMode, nil
+	case "strict":
+		return http.SameSiteStrictMode, nil
+	case "none":
+		return http.SameSiteNoneMode, nil
+	case "default", "":
+		return http.SameSiteDefaultMode, nil
+	}
+
+	return http.SameSiteDefaultMode, errors.New("Invalid cookiesamesite value: " + name)
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strings"
+
+	"github.com/spf13/viper"
+)
+
+// name of dburl connection
+const dbDefaultName = "default"
+
+var errDatabaseNotFound = errors.New("Database not found")
+
+// connect to dburl and named databases of [databases] table, and to their [replicas]
+func databasesNew(ctx context.Context, cfg *viper.Viper) (map[string]*database, error) {
+	dburl := cfg.GetString("dburl")
+	urls := cfg.GetStringMapString("databases")
+	replicas := cfg.GetStringMapStringSlice("replicas")
+	opts := dbOptionsFromCfg(cfg)
+	poolOpts, err := dbPoolOptionsFromCfg(cfg)
+	if err != nil {
+		return nil, err
+	}
+	sessionRole := cfg.GetString("sessionrole")
+	sessionSettings := cfg.GetStringMapString("sessionsettings")
+
+	for name := range replicas {
+		if _, ok := urls[name]; !ok && name != dbDefaultName {
+			return nil, fmt.Errorf("%w: replicas of %s", errDatabaseNotFound, name)
+		}
+	}
+
+	names := make([]string, 0, len(urls)+1)
+	names = append(names, dbDefaultName)
+	for name := range urls {
+		if name != dbDefaultName {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names[1:])
+
+	dbs := make(map[string]*database, len(names))
+	for _, name := range names {
+		url := dburl
+		if name != dbDefaultName {
+			url = urls[name]
+		}
+
+		db, err := dbNew(ctx, url, false, poolOpts, opts, sessionRole, sessionSettings)
+		if err != nil {
+			databasesClose(dbs)
+			return nil, fmt.Errorf("database %s: %w", name, err)
+		}
+		dbs[name] = db
+
+		if urls := replicas[name]; len(urls) > 0 {
+			if db.replicas, err = replicaSetNew(ctx, name, urls, poolOpts, opts, sessionRole, sessionSettings,
+				cfg.GetDuration("replicamaxlag"), cfg.GetDuration("replicacheckperiod"), cfg.GetBool("replicaselect")); err != nil {
+				databasesClose(dbs)
+				return nil, fmt.Errorf("database %s: %w", name, err)
+			}
+		}
+	}
+
+	return dbs, nil
+}
+
+// pool options of all databases and replicas
+func dbPoolOptionsFromCfg(cfg *viper.Viper) (dbPoolOptions, error) {
+	opts := dbPoolOptions{
+		maxConns:          cfg.GetInt32("dbmaxconns"),
+		minConns:          cfg.GetInt32("dbminconns"),
+		maxConnIdleTime:   cfg.GetDuration("dbmaxconnidletime"),
+		maxConnLifetime:   cfg.GetDuration("dbmaxconnlifetime"),
+		healthCheckPeriod: cfg.GetDuration("dbhealthcheckperiod"),
+		applicationName:   cfg.GetString("dbapplicationname"),
+		connectRetries:    cfg.GetInt("dbconnectretries"),
+		connectRetryDelay: cfg.GetDuration("dbconnectretrydelay"),
+	}
+
+	if file := cfg.GetString("dbafterconnect"); file != "" {
+		bin, err := ioutil.ReadFile(file)
+		if err != nil {
+			return opts, err
+		}
+		opts.afterConnect = string(bin)
+	}
+
+	return opts, nil
+}
+
+// names of connected databases
+func databaseNames(dbs map[string]*database) map[string]bool {
+	res := make(map[string]bool, len(dbs))
+	for name := range dbs {
+		res[name] = true
+	}
+	return res
+}
+
+// subdirectories must refer to known databases
+func (dirs databaseDirs) check(databases map[string]bool) error {
+	for dir, name := range dirs {
+		if !databases[strings.ToLower(name)] {
+			return fmt.Errorf("%w: %s of databasedirs %s", errDatabaseNotFound, name, dir)
+		}
+	}
+	return nil
+}
+
+func databasesClose(dbs map[string]*database) {
+	for _, db := range dbs {
+		db.close()
+	}
+}
+
+// default databases of sqlroot subdirectories, key is a subdirectory path relative to sqlroot
+type databaseDirs map[string]string
+
+// database of query name by the longest subdirectory prefix, empty string if there is no one
+func (dirs databaseDirs) find(queryname string) string {
+	name := strings.ToLower(queryname)
+	res, resLen := "", 0
+	for dir, db := range dirs {
+		prefix := "/" + strings.Trim(strings.ToLower(dir), "/") + "/"
+		if len(prefix) > resLen && strings.HasPrefix(name, prefix) {
+			res, resLen = strings.ToLower(db), len(prefix)
+		}
+	}
+	return res
+}
+
+// database name of query
+func (q *query) databaseName() string {
+	if q.database == "" {
+		return dbDefaultName
+	}
+	return q.database
+}
+
+// database of query
+func (srvc *pgmusql) queryDatabase(q *query) (*database, error) {
+	db, ok := srvc.dbs[q.databaseName()]
+	if !ok {
+		return nil, errDatabaseNotFound
+	}
+	return db, nil
+}
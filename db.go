@@ -1,11 +1,18 @@
 package main
 
 import (
+	"bytes"
 	"context"
-	"encoding/json"
 	"errors"
-	"net/url"
+	"log"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
 
+	"github.com/jackc/pgconn"
 	"github.com/jackc/pgx/v4"
 
 	"github.com/jackc/pgx/v4/pgxpool"
@@ -13,29 +20,140 @@ import (
 
 type database struct {
 	pool            *pgxpool.Pool
-	filterOutParams bool
-	filterInParams  bool
-	muteDbErr       bool
+	options         atomic.Value      // dbOptions, can be changed on config reload
+	sessionRole     string            // session column with database role
+	sessionSettings map[string]string // session column to configuration parameter
+	replicas        *replicaSet       // read replicas, nil if there are none
 }
 
-// create db connect
-func dbNew(dburl string, filterOutParams bool, filterInParams bool, muteDbErr bool) (*database, error) {
+// database options that can be changed at runtime
+type dbOptions struct {
+	filterOutParams  bool
+	filterInParams   bool
+	muteDbErr        bool
+	statementTimeout bool
+	txRetries        int
+	txRetryDelay     time.Duration
+}
+
+// database querier, pool or transaction
+type dbQuerier interface {
+	Query(ctx context.Context, sql string, args ...interface{}) (pgx.Rows, error)
+	Exec(ctx context.Context, sql string, args ...interface{}) (pgconn.CommandTag, error)
+}
+
+// connection pool options, zero values keep pgxpool defaults and pool_* params of url
+type dbPoolOptions struct {
+	maxConns          int32
+	minConns          int32
+	maxConnIdleTime   time.Duration
+	maxConnLifetime   time.Duration
+	healthCheckPeriod time.Duration
+	applicationName   string // used if url has no application_name
+	afterConnect      string // sql script executed on every new connection
+	connectRetries    int
+	connectRetryDelay time.Duration // doubled after each failed attempt
+}
+
+// max delay between connect attempts
+const dbConnectMaxDelay = time.Second * 30
+
+// create db connect, lazy pool connects on first query.
+// Not lazy pool connects on create and retries with backoff if database is unreachable.
+func dbNew(ctx context.Context, dburl string, lazy bool, poolOpts dbPoolOptions, opts dbOptions, sessionRole string, sessionSettings map[string]string) (*database, error) {
 	var db database
-	var err error
 
-	if db.pool, err = pgxpool.Connect(context.Background(), dburl); err != nil {
+	poolCfg, err := poolOpts.config(dburl)
+	if err != nil {
 		return nil, err
 	}
+	poolCfg.LazyConnect = lazy
 
-	db.filterOutParams = filterOutParams
-	db.filterInParams = filterInParams
-	db.muteDbErr = muteDbErr
+	delay := poolOpts.connectRetryDelay
+	for attempt := 0; ; attempt++ {
+		if db.pool, err = pgxpool.ConnectConfig(ctx, poolCfg); err == nil {
+			break
+		}
+
+		if attempt >= poolOpts.connectRetries || ctx.Err() != nil {
+			return nil, err
+		}
+
+		log.Printf("Database connect error: %v. Retry %d of %d in %v\n", err, attempt+1, poolOpts.connectRetries, delay)
+		select {
+		case <-ctx.Done():
+			return nil, err
+		case <-time.After(delay):
+		}
+		if delay *= 2; delay > dbConnectMaxDelay {
+			delay = dbConnectMaxDelay
+		}
+	}
+
+	db.setOpts(opts)
+	db.sessionRole = strings.ToLower(sessionRole)
+	db.sessionSettings = sessionSettings
 
 	return &db, nil
 }
 
+// pool config of url with pool options
+func (o dbPoolOptions) config(dburl string) (*pgxpool.Config, error) {
+	poolCfg, err := pgxpool.ParseConfig(dburl)
+	if err != nil {
+		return nil, err
+	}
+
+	if o.maxConns > 0 {
+		poolCfg.MaxConns = o.maxConns
+	}
+	if o.minConns > 0 {
+		poolCfg.MinConns = o.minConns
+	}
+	if o.maxConnIdleTime > 0 {
+		poolCfg.MaxConnIdleTime = o.maxConnIdleTime
+	}
+	if o.maxConnLifetime > 0 {
+		poolCfg.MaxConnLifetime = o.maxConnLifetime
+	}
+	if o.healthCheckPeriod > 0 {
+		poolCfg.HealthCheckPeriod = o.healthCheckPeriod
+	}
+
+	if _, ok := poolCfg.ConnConfig.RuntimeParams["application_name"]; !ok && o.applicationName != "" {
+		poolCfg.ConnConfig.RuntimeParams["application_name"] = o.applicationName
+	}
+
+	// connection setup: search_path, timezone, prepared statements
+	if o.afterConnect != "" {
+		script := o.afterConnect
+		poolCfg.AfterConnect = func(ctx context.Context, conn *pgx.Conn) error {
+			_, err := conn.Exec(ctx, script)
+			return err
+		}
+	}
+
+	return poolCfg, nil
+}
+
+func (db *database) opts() dbOptions {
+	return db.options.Load().(dbOptions)
+}
+
+func (db *database) setOpts(opts dbOptions) {
+	db.options.Store(opts)
+	if db.replicas != nil {
+		for _, r := range db.replicas.replicas {
+			r.db.setOpts(opts)
+		}
+	}
+}
+
 // close db connection
 func (db *database) close() {
+	if db.replicas != nil {
+		db.replicas.close()
+	}
 	db.pool.Close()
 }
 
@@ -43,77 +161,307 @@ func (db *database) close() {
 
 var errQueryDBError = errors.New("Database error")
 
-type dbQueryResult struct {
-	res   []byte
-	total int
-	err   error
+// statement timeout is shorter than query context deadline, so the server cancels the statement
+// and the connection stays alive
+const statementTimeoutGrace = time.Second
+
+// hide database error details if errors are muted, other errors are passed as is
+func (db *database) muteError(err error) error {
+	if !db.opts().muteDbErr || !dbIsServerError(err) {
+		return err
+	}
+
+	return errQueryDBError
 }
 
-func (db *database) queryChannel(ctx context.Context, q query, params url.Values, limit int) <-chan dbQueryResult {
-	res := make(chan dbQueryResult)
-	go func() {
-		r, t, err := db.query(ctx, q, params, limit)
-		res <- dbQueryResult{r, t, err}
-	}()
-	return res
+// error of database server or connection
+func dbIsServerError(err error) bool {
+	var pgErr *pgconn.PgError
+	var netErr net.Error
+	return errors.As(err, &pgErr) || errors.As(err, &netErr) || pgconn.SafeToRetry(err) || pgconn.Timeout(err)
 }
 
-func (db *database) query(ctx context.Context, q query, params url.Values, limit int) (res []byte, total int, err error) {
-	// check err
-	defer func() {
-		if db.muteDbErr && err != nil {
-			err = errQueryDBError
-		}
-	}()
+func (db *database) query(ctx context.Context, q query, params queryParams, format resultFormat, limit int) ([]byte, int, error) {
+	var buf bytes.Buffer
+	total, err := db.encode(ctx, q, params, func() (rowsEncoder, error) {
+		buf.Reset()
+		return format.encoder(&buf), nil
+	}, limit)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return buf.Bytes(), total, nil
+}
+
+// rows encoder factory, called before each attempt to run query.
+// Returns error if result can't be written again.
+type rowsEncoderFactory func() (rowsEncoder, error)
+
+// run query and encode result rows, read-only query runs on replica if there is a healthy one.
+// If replica connection fails, replica is taken out of rotation and query runs on primary.
+// Query that tries to write on replica runs on primary too.
+func (db *database) encode(ctx context.Context, q query, params queryParams, newEncoder rowsEncoderFactory, limit int) (int, error) {
+	if db.replicas == nil || !db.replicas.routable(q) {
+		return db.encodeRows(ctx, q, params, newEncoder, limit)
+	}
+
+	r := db.replicas.pick()
+	if r == nil {
+		return db.encodeRows(ctx, q, params, newEncoder, limit)
+	}
+
+	total, err := r.db.encodeRows(ctx, q, params, newEncoder, limit)
+	if err == nil || ctx.Err() != nil {
+		return total, err
+	}
+
+	switch {
+	case replicaIsDown(err):
+		r.setHealthy(false, err.Error())
+	case !dbIsReadOnlyError(err):
+		return total, err
+	}
+
+	// result can't be written again
+	if _, encErr := newEncoder(); encErr != nil {
+		return 0, err
+	}
+
+	return db.encodeRows(ctx, q, params, newEncoder, limit)
+}
+
+// run query on database pool and encode result rows
+func (db *database) encodeRows(ctx context.Context, q query, params queryParams, newEncoder rowsEncoderFactory, limit int) (int, error) {
+	// session role and settings
+	settings, err := db.sessionConfig(params)
+	if err != nil {
+		return 0, err
+	}
+
+	opts := db.opts()
 
 	// prepare query params
-	var prms []interface{}
-	if prms, err = q.params.prepare(params, db.filterInParams); err != nil {
-		return
+	prms, err := q.params.prepare(params, opts.filterInParams)
+	if err != nil {
+		return 0, err
 	}
 
-	// run query
-	var rows pgx.Rows
-	if rows, err = db.pool.Query(ctx, q.body, prms...); err != nil {
-		return
+	enc, err := newEncoder()
+	if err != nil {
+		return 0, err
 	}
-	defer rows.Close()
 
-	// conver db rows to json
-	return dbRowsToJSON(rows, db.filterOutParams, q.out, limit)
+	// statement timeout is set by context deadline, it, session settings, multiple statements and transaction options need transaction
+	deadline, hasDeadline := ctx.Deadline()
+	stmtTimeout := opts.statementTimeout && hasDeadline
+	if !stmtTimeout && len(settings) == 0 && len(q.statements) <= 1 && q.txOptions == (pgx.TxOptions{}) {
+		return dbQueryEncode(ctx, db.pool, q, prms, opts.filterOutParams, enc, limit)
+	}
+
+	for attempt := 0; ; attempt++ {
+		total, err := db.inTx(ctx, q.txOptions, func(tx pgx.Tx) (int, error) {
+			if stmtTimeout {
+				timeout := time.Until(deadline) - statementTimeoutGrace
+				if timeout < time.Millisecond {
+					timeout = time.Millisecond // zero disables statement timeout
+				}
+				if _, err := tx.Exec(ctx, "select set_config('statement_timeout', $1, true)", strconv.FormatInt(timeout.Milliseconds(), 10)); err != nil {
+					return 0, err
+				}
+			}
+
+			// local settings are reset at the end of transaction, so they never leak to another request
+			for _, setting := range settings {
+				if _, err := tx.Exec(ctx, "select set_config($1, $2, true)", setting.name, setting.value); err != nil {
+					return 0, err
+				}
+			}
+
+			return dbQueryEncode(ctx, tx, q, prms, opts.filterOutParams, enc, limit)
+		})
+
+		// retry serializable transaction
+		if err == nil || q.txOptions.IsoLevel != pgx.Serializable || attempt >= opts.txRetries || !dbIsRetryable(err) {
+			return total, err
+		}
+
+		var encErr error
+		if enc, encErr = newEncoder(); encErr != nil {
+			return 0, err
+		}
+
+		select {
+		case <-ctx.Done():
+			return 0, err
+		case <-time.After(opts.txRetryDelay * time.Duration(attempt+1)):
+		}
+	}
 }
 
-// db row to json converter
-func dbRowsToJSON(rows pgx.Rows, filterOutParams bool, outparams dirParamList, limit int) ([]byte, int, error) {
-	table := make([]map[string]interface{}, 0)
+// configuration parameter set in query transaction
+type dbSetting struct {
+	name  string
+	value string
+}
 
-	i := 0
-	for rows.Next() && (limit == 0 || i < limit) {
-		trow := make(map[string]interface{}, 0)
-		fields := rows.FieldDescriptions()
+// session role and settings of query, role goes first.
+// Session without role is denied, query without session runs as dburl user.
+func (db *database) sessionConfig(params queryParams) ([]dbSetting, error) {
+	var res []dbSetting
+	if db.sessionRole != "" && params.hasSession() {
+		val, ok := params[sessionParamPrefix+db.sessionRole]
+		if !ok || val == nil {
+			return nil, errAccessDenied
+		}
 
-		val, err := rows.Values()
+		str, err := jsonValueString(val)
 		if err != nil {
-			return nil, 0, err
+			return nil, err
 		}
+		res = append(res, dbSetting{"role", str})
+	}
 
-		for i, column := range fields {
-			if filterOutParams {
-				if find, _ := outparams.find(string(column.Name)); !find {
-					continue
-				}
+	columns := make([]string, 0, len(db.sessionSettings))
+	for column := range db.sessionSettings {
+		columns = append(columns, column)
+	}
+	sort.Strings(columns)
+
+	for _, column := range columns {
+		val, ok := params[sessionParamPrefix+column]
+		if !ok {
+			continue
+		}
+
+		// null is an empty setting
+		str := ""
+		if val != nil {
+			var err error
+			if str, err = jsonValueString(val); err != nil {
+				return nil, err
 			}
-			trow[string(column.Name)] = val[i]
 		}
+		res = append(res, dbSetting{db.sessionSettings[column], str})
+	}
 
-		table = append(table, trow)
-		i++
+	return res, nil
+}
+
+// transaction can be retried after serialization_failure or deadlock_detected
+func dbIsRetryable(err error) bool {
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) {
+		return pgErr.Code == "40001" || pgErr.Code == "40P01"
+	}
+	return false
+}
+
+// read_only_sql_transaction, query writes on standby or in read-only transaction
+func dbIsReadOnlyError(err error) bool {
+	var pgErr *pgconn.PgError
+	return errors.As(err, &pgErr) && pgErr.Code == "25006"
+}
+
+// run function in transaction, commit on success and rollback on error
+func (db *database) inTx(ctx context.Context, txOptions pgx.TxOptions, fn func(tx pgx.Tx) (int, error)) (int, error) {
+	tx, err := db.pool.BeginTx(ctx, txOptions)
+	if err != nil {
+		return 0, err
 	}
 
-	jsn, err := json.Marshal(table)
+	total, err := fn(tx)
 	if err != nil {
-		return nil, 0, err
+		// failed rollback closes the connection, so it never goes back to the pool in transaction
+		tx.Rollback(ctx)
+		return 0, err
+	}
+
+	if err = tx.Commit(ctx); err != nil {
+		return 0, err
+	}
+
+	return total, nil
+}
+
+// run query statements and encode rows of result statement
+func dbQueryEncode(ctx context.Context, querier dbQuerier, q query, prms []interface{}, filterOutParams bool, enc rowsEncoder, limit int) (int, error) {
+	// empty query
+	if len(q.statements) == 0 {
+		if err := enc.begin(nil); err != nil {
+			return 0, err
+		}
+		return 0, enc.end()
+	}
+
+	total := 0
+	for i, stmt := range q.statements {
+		if i != q.result {
+			if _, err := querier.Exec(ctx, stmt.body, stmt.args(prms)...); err != nil {
+				return 0, err
+			}
+			continue
+		}
+
+		rows, err := querier.Query(ctx, stmt.body, stmt.args(prms)...)
+		if err != nil {
+			return 0, err
+		}
+
+		total, err = dbRowsEncode(rows, filterOutParams, q.out, enc, limit)
+		rows.Close()
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	return total, nil
+}
+
+// db rows encoder, columns are in query fields order
+func dbRowsEncode(rows pgx.Rows, filterOutParams bool, outparams dirParamList, enc rowsEncoder, limit int) (int, error) {
+	// output columns
+	var columns []string
+	var indexes []int
+	for i, column := range rows.FieldDescriptions() {
+		if filterOutParams {
+			if find, _ := outparams.find(string(column.Name)); !find {
+				continue
+			}
+		}
+		columns = append(columns, string(column.Name))
+		indexes = append(indexes, i)
+	}
+
+	if err := enc.begin(columns); err != nil {
+		return 0, err
+	}
+
+	i := 0
+	row := make([]interface{}, len(indexes))
+	for (limit == 0 || i < limit) && rows.Next() {
+		val, err := rows.Values()
+		if err != nil {
+			return 0, err
+		}
+
+		for j, index := range indexes {
+			row[j] = val[index]
+		}
+
+		if err := enc.row(row); err != nil {
+			return 0, err
+		}
+		i++
+	}
+
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	if err := enc.end(); err != nil {
+		return 0, err
 	}
 
-	return jsn, len(table), nil
+	return i, nil
 }
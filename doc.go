@@ -2,15 +2,21 @@ package main
 
 import (
 	"encoding/json"
+	"fmt"
 	"html/template"
 	"net/http"
 	"sort"
+	"strconv"
 	"strings"
 	"time"
+
+	"github.com/jackc/pgx/v4"
 )
 
 type docParam struct {
 	Name        string
+	Type        string
+	Mode        string
 	Description string
 	Warning     string
 }
@@ -22,11 +28,19 @@ type sqlDescription struct {
 	Out          []docParam
 	LoadTime     string
 	Timeout      string
+	Format       string
+	Stream       string
+	Statements   string
+	Transaction  string
+	Database     string
+	Access       string
+	Limits       string
 	ParseWarn    string
 	TestPass     string
 	TestParams   []docParam
 	TestDuration string
 	Err          string
+	ReloadErr    string
 	TestResult   string
 	HasWarn      bool
 	HasErr       bool
@@ -54,12 +68,17 @@ func (d *sqlDescription) parse(q *query) {
 			d.HasWarn = true
 		}
 
-		d.In = append(d.In, docParam{param.key, param.value, warn})
+		mode := param.mode.String()
+		if param.mode == paramModeDefault {
+			mode += ": " + param.defval
+		}
+
+		d.In = append(d.In, docParam{param.key, param.ptype, mode, param.value, warn})
 	}
 
 	for _, param := range q.params {
-		if find, _ := q.in.find(param); !find {
-			d.In = append(d.In, docParam{param, "", "Used but not declared"})
+		if find, _ := q.in.find(param.name); !find {
+			d.In = append(d.In, docParam{param.name, "", "", "", "Used but not declared"})
 			d.HasWarn = true
 		}
 	}
@@ -84,13 +103,13 @@ func (d *sqlDescription) parse(q *query) {
 			}
 		}
 
-		d.Out = append(d.Out, docParam{param.key, param.value, warn})
+		d.Out = append(d.Out, docParam{param.key, param.ptype, "", param.value, warn})
 	}
 
 	if hasTest {
 		for column := range testResult[0] {
 			if find, _ := q.out.find(column); !find {
-				d.Out = append(d.Out, docParam{column, "", "Field found in test request but not described"})
+				d.Out = append(d.Out, docParam{column, "", "", "", "Field found in test request but not described"})
 				d.HasWarn = true
 			}
 		}
@@ -105,6 +124,42 @@ func (d *sqlDescription) parse(q *query) {
 		d.Timeout = q.timeout.String()
 	}
 
+	// format
+	d.Format = q.format.String()
+
+	// statements
+	d.Statements = strconv.Itoa(len(q.statements))
+	if len(q.statements) > 1 {
+		d.Statements += fmt.Sprintf(" in one transaction, result of statement %d", q.result+1)
+	}
+
+	// transaction options
+	d.Transaction = "Default"
+	if q.txOptions != (pgx.TxOptions{}) {
+		var opts []string
+		for _, opt := range []string{string(q.txOptions.IsoLevel), string(q.txOptions.AccessMode), string(q.txOptions.DeferrableMode)} {
+			if opt != "" {
+				opts = append(opts, opt)
+			}
+		}
+		d.Transaction = strings.Join(opts, ", ")
+	}
+
+	// database
+	d.Database = q.databaseName()
+
+	// access
+	d.Access = q.access.String()
+
+	// limits
+	d.Limits = q.limits.String()
+
+	// stream
+	d.Stream = "Default"
+	if q.stream != nil {
+		d.Stream = strconv.FormatBool(*q.stream)
+	}
+
 	// parse warn
 	if d.ParseWarn = q.parsewarn; d.ParseWarn != "" {
 		d.HasWarn = true
@@ -117,7 +172,7 @@ func (d *sqlDescription) parse(q *query) {
 	d.TestParams = make([]docParam, 0)
 
 	for _, param := range q.testparams {
-		d.TestParams = append(d.TestParams, docParam{param.key, param.value, ""})
+		d.TestParams = append(d.TestParams, docParam{param.key, "", "", param.value, ""})
 	}
 
 	// test duration
@@ -138,6 +193,12 @@ func (d *sqlDescription) parse(q *query) {
 		d.HasErr = true
 		d.Err = q.err.Error()
 	}
+
+	// reload error
+	if q.reloaderr != nil {
+		d.HasErr = true
+		d.ReloadErr = q.reloaderr.Error()
+	}
 }
 
 type sqlTreeViewNode struct {
@@ -226,12 +287,17 @@ func (srvc *pgmusql) docHandler(rw http.ResponseWriter, req *http.Request) {
 	var err error
 
 	if docTmplt, err = template.ParseGlob("html/*.gohtml"); err != nil {
-		http.Error(rw, err.Error(), http.StatusInternalServerError)
+		srvc.writeError(rw, http.StatusInternalServerError, err)
+		return
 	}
 
 	rw.Header().Set("Content-Type", srvcOutputHTMLType)
 
-	if err := docTmplt.ExecuteTemplate(rw, "Main", srvc.sqlTreeView); err != nil {
+	srvc.queriesLock.RLock()
+	treeView := srvc.sqlTreeView
+	srvc.queriesLock.RUnlock()
+
+	if err := docTmplt.ExecuteTemplate(rw, "Main", treeView); err != nil {
 		http.Error(rw, err.Error(), http.StatusInternalServerError)
 	}
 }
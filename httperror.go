@@ -0,0 +1,188 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/jackc/pgconn"
+	"github.com/spf13/cast"
+)
+
+// error response envelope
+type errorResponse struct {
+	Error errorBody `json:"error"`
+}
+
+type errorBody struct {
+	Code       string   `json:"code"`
+	Message    string   `json:"message"`
+	Param      string   `json:"param,omitempty"`
+	Params     []string `json:"params,omitempty"`
+	SQLState   string   `json:"sqlstate,omitempty"`
+	Detail     string   `json:"detail,omitempty"`
+	Hint       string   `json:"hint,omitempty"`
+	Constraint string   `json:"constraint,omitempty"`
+}
+
+// default SQLSTATE to HTTP status mapping, can be extended by "sqlstatestatus" config table
+var defaultSQLStateStatus = map[string]int{
+	"23505": http.StatusConflict,            // unique_violation
+	"23503": http.StatusUnprocessableEntity, // foreign_key_violation
+	"23514": http.StatusUnprocessableEntity, // check_violation
+	"42501": http.StatusForbidden,           // insufficient_privilege
+	"57014": http.StatusGatewayTimeout,      // query_canceled
+}
+
+type sqlStateMapper struct {
+	status map[string]int
+	prefix string // custom SQLSTATE prefix, the rest of the code is HTTP status (for example PM404)
+}
+
+func sqlStateMapperNew(cfgStatus map[string]interface{}, prefix string) *sqlStateMapper {
+	m := sqlStateMapper{
+		status: make(map[string]int),
+		prefix: strings.ToUpper(prefix),
+	}
+
+	for code, status := range defaultSQLStateStatus {
+		m.status[code] = status
+	}
+
+	for code, status := range cfgStatus {
+		m.status[strings.ToUpper(code)] = cast.ToInt(status)
+	}
+
+	return &m
+}
+
+// HTTP status of SQLSTATE
+func (m *sqlStateMapper) httpStatus(sqlState string) int {
+	if status, ok := m.status[sqlState]; ok {
+		return status
+	}
+
+	if m.prefix != "" && strings.HasPrefix(sqlState, m.prefix) {
+		if status, err := strconv.Atoi(sqlState[len(m.prefix):]); err == nil && status >= 100 && status <= 599 {
+			return status
+		}
+	}
+
+	return http.StatusInternalServerError
+}
+
+// database error of bad credentials: invalid_authorization_specification class
+// or SQLSTATE mapped to 401 or 403 status, for example RAISE with PM401
+func (srvc *pgmusql) isAuthError(err error) bool {
+	var pgErr *pgconn.PgError
+	if !errors.As(err, &pgErr) {
+		return false
+	}
+
+	if strings.HasPrefix(pgErr.Code, "28") {
+		return true
+	}
+
+	status := srvc.opts().sqlStates.httpStatus(pgErr.Code)
+	return status == http.StatusUnauthorized || status == http.StatusForbidden
+}
+
+// status, error code and client message of error
+func (srvc *pgmusql) describeError(err error) (int, errorBody) {
+	body := errorBody{Message: srvc.db.muteError(err).Error()}
+	status := http.StatusInternalServerError
+
+	switch e := err.(type) {
+	case *paramError:
+		status, body.Code, body.Param = http.StatusBadRequest, "invalid_param", e.name
+	case paramsMissingError:
+		status, body.Code, body.Params = http.StatusBadRequest, "missing_params", e
+	case paramsUnknownError:
+		status, body.Code, body.Params = http.StatusBadRequest, "unknown_params", e
+	case *requestError:
+		status, body.Code = http.StatusBadRequest, "invalid_request"
+	case *rateLimitError:
+		status, body.Code = http.StatusTooManyRequests, "rate_limited"
+	case *pgconn.PgError:
+		status, body.Code = srvc.opts().sqlStates.httpStatus(e.Code), "database_error"
+		if !srvc.db.opts().muteDbErr {
+			body.SQLState = e.Code
+			body.Detail = e.Detail
+			body.Hint = e.Hint
+			body.Constraint = e.ConstraintName
+		}
+	}
+
+	if body.Code != "" {
+		return status, body
+	}
+
+	switch err {
+	case errQueryNotFound:
+		status, body.Code = http.StatusNotFound, "query_not_found"
+	case errQueryTimeout:
+		status, body.Code = http.StatusGatewayTimeout, "query_timeout"
+	case errQueryContexDone:
+		status, body.Code = http.StatusServiceUnavailable, "request_canceled"
+	case errContentType, errJSONNotObject, errJSONTrailingData:
+		status, body.Code = http.StatusBadRequest, "invalid_request"
+	case errNoSession, http.ErrNoCookie:
+		status, body.Code = http.StatusUnauthorized, "no_session"
+	case errSessionInvalid:
+		status, body.Code = http.StatusUnauthorized, "invalid_session"
+	case errQueryProhibited:
+		status, body.Code = http.StatusForbidden, "query_prohibited"
+	case errAPIKeyInvalid:
+		status, body.Code = http.StatusUnauthorized, "invalid_api_key"
+	case errCSRFToken:
+		status, body.Code = http.StatusForbidden, "invalid_csrf_token"
+	case errAccessDenied:
+		status, body.Code = http.StatusForbidden, "access_denied"
+	case errConcurrencyLimited:
+		status, body.Code = http.StatusServiceUnavailable, "concurrency_limited"
+	case errLoginLocked:
+		status, body.Code = http.StatusTooManyRequests, "too_many_attempts"
+	case errLoginNoData:
+		status, body.Code = http.StatusForbidden, "login_failed"
+	case errQueryDBError:
+		body.Code = "database_error"
+	default:
+		body.Code = "internal_error"
+	}
+
+	return status, body
+}
+
+// write error response, if status is 0 then it is chosen by error
+func (srvc *pgmusql) writeError(rw http.ResponseWriter, status int, err error) {
+	errStatus, body := srvc.describeError(err)
+	if status == 0 {
+		status = errStatus
+	}
+
+	jsn, jerr := json.Marshal(errorResponse{body})
+	if jerr != nil {
+		log.Println(jerr)
+		http.Error(rw, err.Error(), status)
+		return
+	}
+
+	rw.Header().Set("Content-Type", srvcOutputContentType)
+	rw.Header().Set("X-Content-Type-Options", "nosniff")
+	rw.WriteHeader(status)
+	rw.Write(jsn)
+}
+
+// error envelope as a string, used in stream trailer
+func (srvc *pgmusql) errorString(err error) string {
+	_, body := srvc.describeError(err)
+	jsn, jerr := json.Marshal(errorResponse{body})
+	if jerr != nil {
+		return err.Error()
+	}
+
+	return string(jsn)
+}
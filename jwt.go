@@ -0,0 +1,420 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"hash"
+	"io/ioutil"
+	"math/big"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// registered claims, the rest of claims is the login query result row
+const (
+	jwtClaimExpire   = "exp"
+	jwtClaimIssuedAt = "iat"
+	jwtClaimAuthTime = "auth_time" // login time, used for max lifetime
+	jwtClaimID       = "jti"
+)
+
+var jwtRegisteredClaims = []string{jwtClaimExpire, jwtClaimIssuedAt, jwtClaimAuthTime, jwtClaimID, "nbf", "iss", "sub", "aud"}
+
+var (
+	errJWTKeyNotFound   = errors.New("JWT signing key is not found")
+	errJWTKeyType       = errors.New("Unsupported JWT key type")
+	errJWTPrivateKey    = errors.New("JWT signing key must be a private key or a secret")
+	errJWTClaimReserved = errors.New("Login query column name is a registered JWT claim")
+)
+
+// key of key set
+type jwtKey struct {
+	alg     string
+	secret  []byte           // HS256
+	private crypto.Signer    // RS256, ES256, ES384, ES512
+	public  crypto.PublicKey // verification key
+	hash    func() hash.Hash // signature hash
+}
+
+// load key file. PEM file is a RSA or EC key, private or public (verification only).
+// Any other file content is a HS256 secret.
+func jwtKeyLoad(path string) (*jwtKey, error) {
+	bin, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	block, _ := pem.Decode(bin)
+	if block == nil {
+		secret := bytes.TrimSpace(bin)
+		if len(secret) == 0 {
+			return nil, fmt.Errorf("%s: empty secret", path)
+		}
+		return &jwtKey{alg: "HS256", secret: secret, hash: func() hash.Hash { return sha256.New() }}, nil
+	}
+
+	var key interface{}
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		key, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "EC PRIVATE KEY":
+		key, err = x509.ParseECPrivateKey(block.Bytes)
+	case "PRIVATE KEY":
+		key, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	case "PUBLIC KEY":
+		key, err = x509.ParsePKIXPublicKey(block.Bytes)
+	default:
+		err = errJWTKeyType
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+
+	var res jwtKey
+	if signer, ok := key.(crypto.Signer); ok {
+		res.private = signer
+		key = signer.Public()
+	}
+	res.public = key
+
+	switch k := key.(type) {
+	case *rsa.PublicKey:
+		res.alg, res.hash = "RS256", func() hash.Hash { return sha256.New() }
+	case *ecdsa.PublicKey:
+		switch k.Curve {
+		case elliptic.P256():
+			res.alg, res.hash = "ES256", func() hash.Hash { return sha256.New() }
+		case elliptic.P384():
+			res.alg, res.hash = "ES384", func() hash.Hash { return sha512.New384() }
+		case elliptic.P521():
+			res.alg, res.hash = "ES512", func() hash.Hash { return sha512.New() }
+		default:
+			return nil, fmt.Errorf("%s: %w", path, errJWTKeyType)
+		}
+	default:
+		return nil, fmt.Errorf("%s: %w", path, errJWTKeyType)
+	}
+
+	return &res, nil
+}
+
+func (k *jwtKey) sign(data []byte) ([]byte, error) {
+	if k.secret != nil {
+		mac := hmac.New(sha256.New, k.secret)
+		mac.Write(data)
+		return mac.Sum(nil), nil
+	}
+
+	h := k.hash()
+	h.Write(data)
+	digest := h.Sum(nil)
+
+	switch priv := k.private.(type) {
+	case *rsa.PrivateKey:
+		return rsa.SignPKCS1v15(rand.Reader, priv, crypto.SHA256, digest)
+	case *ecdsa.PrivateKey:
+		r, s, err := ecdsa.Sign(rand.Reader, priv, digest)
+		if err != nil {
+			return nil, err
+		}
+
+		// signature is fixed size r || s
+		size := (priv.Curve.Params().BitSize + 7) / 8
+		sig := make([]byte, 2*size)
+		rb, sb := r.Bytes(), s.Bytes()
+		copy(sig[size-len(rb):size], rb)
+		copy(sig[2*size-len(sb):], sb)
+		return sig, nil
+	}
+
+	return nil, errJWTPrivateKey
+}
+
+func (k *jwtKey) verify(data []byte, sig []byte) bool {
+	if k.secret != nil {
+		mac := hmac.New(sha256.New, k.secret)
+		mac.Write(data)
+		return hmac.Equal(sig, mac.Sum(nil))
+	}
+
+	h := k.hash()
+	h.Write(data)
+	digest := h.Sum(nil)
+
+	switch pub := k.public.(type) {
+	case *rsa.PublicKey:
+		return rsa.VerifyPKCS1v15(pub, crypto.SHA256, digest, sig) == nil
+	case *ecdsa.PublicKey:
+		size := (pub.Curve.Params().BitSize + 7) / 8
+		if len(sig) != 2*size {
+			return false
+		}
+		r := new(big.Int).SetBytes(sig[:size])
+		s := new(big.Int).SetBytes(sig[size:])
+		return ecdsa.Verify(pub, digest, r, s)
+	}
+
+	return false
+}
+
+type jwtHeader struct {
+	Alg string `json:"alg"`
+	Typ string `json:"typ"`
+	Kid string `json:"kid,omitempty"`
+}
+
+// stateless sessions, session data is stored in the signed token claims
+type jwtSessions struct {
+	keys        map[string]*jwtKey // key set by key id
+	signKid     string             // key id of signing key
+	lifeTime    time.Duration
+	maxLifeTime time.Duration
+	denylist    *sessions // revoked tokens ids, nil if disabled
+}
+
+func jwtSessionsNew(keyFiles map[string]string, signKid string, lifeTime time.Duration, maxLifeTime time.Duration, denylist *sessions) (*jwtSessions, error) {
+	s := jwtSessions{
+		keys:        make(map[string]*jwtKey),
+		signKid:     strings.ToLower(signKid),
+		lifeTime:    lifeTime,
+		maxLifeTime: maxLifeTime,
+		denylist:    denylist,
+	}
+
+	for kid, path := range keyFiles {
+		key, err := jwtKeyLoad(path)
+		if err != nil {
+			return nil, err
+		}
+		s.keys[strings.ToLower(kid)] = key
+	}
+
+	if key, ok := s.keys[s.signKid]; !ok {
+		return nil, fmt.Errorf("%w: %s", errJWTKeyNotFound, signKid)
+	} else if key.secret == nil && key.private == nil {
+		return nil, fmt.Errorf("%w: %s", errJWTPrivateKey, signKid)
+	}
+
+	return &s, nil
+}
+
+// session expiration time, not later than max lifetime since login
+func (s *jwtSessions) expire(created time.Time, now time.Time) time.Time {
+	expire := now.Add(s.lifeTime)
+	if s.maxLifeTime > 0 && expire.After(created.Add(s.maxLifeTime)) {
+		expire = created.Add(s.maxLifeTime)
+	}
+	return expire
+}
+
+// sign token with session claims
+func (s *jwtSessions) issue(sess session) (string, error) {
+	claims := make(map[string]interface{}, len(sess.data)+4)
+	for key, val := range sess.data {
+		claims[key] = val
+	}
+
+	id, err := uuid.NewRandom()
+	if err != nil {
+		return "", err
+	}
+	claims[jwtClaimID] = id.String()
+	claims[jwtClaimIssuedAt] = time.Now().Unix()
+	claims[jwtClaimAuthTime] = sess.created.Unix()
+	claims[jwtClaimExpire] = sess.expire.Unix()
+
+	key := s.keys[s.signKid]
+	header, err := json.Marshal(jwtHeader{Alg: key.alg, Typ: "JWT", Kid: s.signKid})
+	if err != nil {
+		return "", err
+	}
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+
+	token := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	sig, err := key.sign([]byte(token))
+	if err != nil {
+		return "", err
+	}
+
+	return token + "." + base64.RawURLEncoding.EncodeToString(sig), nil
+}
+
+// verify token signature and expiration, returns claims
+func (s *jwtSessions) parse(token string) (map[string]interface{}, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errSessionInvalid
+	}
+
+	bin, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, errSessionInvalid
+	}
+	var header jwtHeader
+	if err := json.Unmarshal(bin, &header); err != nil {
+		return nil, errSessionInvalid
+	}
+
+	// algorithm must match the key, so the token can't choose how it is verified
+	key, ok := s.keys[strings.ToLower(header.Kid)]
+	if !ok || key.alg != header.Alg {
+		return nil, errSessionInvalid
+	}
+
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil || !key.verify([]byte(parts[0]+"."+parts[1]), sig) {
+		return nil, errSessionInvalid
+	}
+
+	if bin, err = base64.RawURLEncoding.DecodeString(parts[1]); err != nil {
+		return nil, errSessionInvalid
+	}
+	var claims map[string]interface{}
+	dec := json.NewDecoder(bytes.NewReader(bin))
+	dec.UseNumber()
+	if err := dec.Decode(&claims); err != nil {
+		return nil, errSessionInvalid
+	}
+
+	now := time.Now()
+	if now.After(jwtClaimTime(claims, jwtClaimExpire)) {
+		return nil, errSessionInvalid
+	}
+	if _, ok := claims["nbf"]; ok && now.Before(jwtClaimTime(claims, "nbf")) {
+		return nil, errSessionInvalid
+	}
+
+	return claims, nil
+}
+
+// numeric date claim
+func jwtClaimTime(claims map[string]interface{}, name string) time.Time {
+	if num, ok := claims[name].(json.Number); ok {
+		if sec, err := num.Int64(); err == nil {
+			return time.Unix(sec, 0)
+		}
+	}
+	return time.Time{}
+}
+
+func (s *jwtSessions) new(ctx context.Context, data queryParams) (string, time.Time, error) {
+	for _, claim := range jwtRegisteredClaims {
+		if _, ok := data[claim]; ok {
+			return "", time.Time{}, fmt.Errorf("%w: %s", errJWTClaimReserved, claim)
+		}
+	}
+
+	now := time.Now()
+	sess := session{created: now, expire: s.expire(now, now), data: data}
+	token, err := s.issue(sess)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+
+	return token, sess.expire, nil
+}
+
+func (s *jwtSessions) check(ctx context.Context, key string) (session, error) {
+	claims, err := s.parse(key)
+	if err != nil {
+		return session{}, err
+	}
+
+	// revoked token
+	if s.denylist != nil {
+		if id, ok := claims[jwtClaimID].(string); ok {
+			if _, err := s.denylist.check(ctx, id); err == nil {
+				return session{}, errSessionInvalid
+			} else if err != errSessionInvalid {
+				return session{}, err
+			}
+		}
+	}
+
+	sess := session{
+		created: jwtClaimTime(claims, jwtClaimAuthTime),
+		expire:  jwtClaimTime(claims, jwtClaimExpire),
+		data:    make(queryParams, len(claims)),
+	}
+	for key, val := range claims {
+		sess.data[key] = val
+	}
+	for _, claim := range jwtRegisteredClaims {
+		delete(sess.data, claim)
+	}
+
+	return sess, nil
+}
+
+// new token with the same claims and renewed expiration, old token is revoked if denylist is enabled
+func (s *jwtSessions) refresh(ctx context.Context, key string) (string, session, error) {
+	sess, err := s.check(ctx, key)
+	if err != nil {
+		return "", session{}, err
+	}
+
+	if err := s.logout(ctx, key); err != nil {
+		return "", session{}, err
+	}
+
+	sess.expire = s.expire(sess.created, time.Now())
+	token, err := s.issue(sess)
+	if err != nil {
+		return "", session{}, err
+	}
+
+	return token, sess, nil
+}
+
+// add token id to denylist until token expiration
+func (s *jwtSessions) logout(ctx context.Context, key string) error {
+	if s.denylist == nil {
+		return nil
+	}
+
+	claims, err := s.parse(key)
+	if err != nil {
+		return nil
+	}
+
+	id, ok := claims[jwtClaimID].(string)
+	if !ok {
+		return nil
+	}
+
+	err = s.denylist.store.add(ctx, id, session{created: time.Now(), expire: jwtClaimTime(claims, jwtClaimExpire)})
+	if err == errSessionColision {
+		return nil
+	}
+	return err
+}
+
+// tokens are not extended on each request, use /refresh
+func (s *jwtSessions) slidingExpiration() bool {
+	return false
+}
+
+func (s *jwtSessions) gcStop() {
+	if s.denylist != nil {
+		s.denylist.gcStop()
+	}
+}
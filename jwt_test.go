@@ -0,0 +1,452 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"hash"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// test key files by key id
+type jwtTestKeys struct {
+	dir   string
+	files map[string]string
+	rsOld *rsa.PrivateKey // private key of "rsold" verification key
+}
+
+func jwtTestKeysNew(t *testing.T) *jwtTestKeys {
+	dir, err := ioutil.TempDir("", "pgmusql-jwt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys := jwtTestKeys{dir: dir, files: make(map[string]string)}
+
+	write := func(kid string, content []byte) {
+		path := filepath.Join(dir, kid)
+		if err := ioutil.WriteFile(path, content, 0600); err != nil {
+			t.Fatal(err)
+		}
+		keys.files[kid] = path
+	}
+	writePEM := func(kid string, typ string, der []byte) {
+		write(kid, pem.EncodeToMemory(&pem.Block{Type: typ, Bytes: der}))
+	}
+	writeEC := func(kid string, curve elliptic.Curve) {
+		key, err := ecdsa.GenerateKey(curve, rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		der, err := x509.MarshalECPrivateKey(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		writePEM(kid, "EC PRIVATE KEY", der)
+	}
+
+	write("hs", []byte("first secret\n"))
+	write("hs2", []byte("second secret"))
+
+	rs, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writePEM("rs", "RSA PRIVATE KEY", x509.MarshalPKCS1PrivateKey(rs))
+
+	// verification only key of previous rotation
+	if keys.rsOld, err = rsa.GenerateKey(rand.Reader, 2048); err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalPKIXPublicKey(&keys.rsOld.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writePEM("rsold", "PUBLIC KEY", der)
+
+	writeEC("es256", elliptic.P256())
+	writeEC("es384", elliptic.P384())
+	writeEC("es512", elliptic.P521())
+
+	return &keys
+}
+
+func (keys *jwtTestKeys) remove() {
+	os.RemoveAll(keys.dir)
+}
+
+// token with arbitrary header and claims signed by key
+func jwtTestToken(t *testing.T, key *jwtKey, header jwtHeader, claims map[string]interface{}) string {
+	bin, err := json.Marshal(header)
+	if err != nil {
+		t.Fatal(err)
+	}
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	token := base64.RawURLEncoding.EncodeToString(bin) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	sig, err := key.sign([]byte(token))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return token + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+func TestJWTKeyLoad(t *testing.T) {
+	keys := jwtTestKeysNew(t)
+	defer keys.remove()
+
+	// PKCS8 and unsupported key files
+	ec, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(ec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := map[string][]byte{
+		"pkcs8":       pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}),
+		"certificate": pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: []byte{1}}),
+		"empty":       []byte(" \n"),
+	}
+	for name, content := range files {
+		path := filepath.Join(keys.dir, name)
+		if err := ioutil.WriteFile(path, content, 0600); err != nil {
+			t.Fatal(err)
+		}
+		keys.files[name] = path
+	}
+
+	tests := []struct {
+		kid     string
+		alg     string
+		private bool
+		err     bool
+	}{
+		{"hs", "HS256", false, false},
+		{"rs", "RS256", true, false},
+		{"rsold", "RS256", false, false},
+		{"es256", "ES256", true, false},
+		{"es384", "ES384", true, false},
+		{"es512", "ES512", true, false},
+		{"pkcs8", "ES256", true, false},
+		{"certificate", "", false, true},
+		{"empty", "", false, true},
+		{"missing", "", false, true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.kid, func(t *testing.T) {
+			key, err := jwtKeyLoad(filepath.Join(keys.dir, test.kid))
+			if (err != nil) != test.err {
+				t.Fatalf("error is %v, expected error %v", err, test.err)
+			}
+			if err != nil {
+				return
+			}
+
+			if key.alg != test.alg {
+				t.Errorf("alg is %s, expected %s", key.alg, test.alg)
+			}
+			if (key.private != nil) != test.private {
+				t.Errorf("private key is %v, expected %v", key.private != nil, test.private)
+			}
+			if key.alg == "HS256" && string(key.secret) != "first secret" {
+				t.Errorf("secret is %q, surrounding whitespace must be trimmed", key.secret)
+			}
+		})
+	}
+}
+
+func TestJWTSessionsNew(t *testing.T) {
+	keys := jwtTestKeysNew(t)
+	defer keys.remove()
+
+	tests := []struct {
+		name    string
+		signKid string
+		err     error
+	}{
+		{"secret", "hs", nil},
+		{"private key", "RS", nil},
+		{"unknown key", "none", errJWTKeyNotFound},
+		{"public key", "rsold", errJWTPrivateKey},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := jwtSessionsNew(keys.files, test.signKid, time.Hour, 0, nil)
+			if !errors.Is(err, test.err) {
+				t.Errorf("error is %v, expected %v", err, test.err)
+			}
+		})
+	}
+}
+
+func TestJWTRoundTrip(t *testing.T) {
+	keys := jwtTestKeysNew(t)
+	defer keys.remove()
+
+	tests := []struct {
+		kid string
+		alg string
+	}{
+		{"hs", "HS256"},
+		{"rs", "RS256"},
+		{"es256", "ES256"},
+		{"es384", "ES384"},
+		{"es512", "ES512"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.alg, func(t *testing.T) {
+			s, err := jwtSessionsNew(keys.files, test.kid, time.Hour, 0, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			token, expire, err := s.new(context.Background(), queryParams{"user": "alice", "role": "admin"})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			bin, err := base64.RawURLEncoding.DecodeString(strings.Split(token, ".")[0])
+			if err != nil {
+				t.Fatal(err)
+			}
+			var header jwtHeader
+			if err := json.Unmarshal(bin, &header); err != nil {
+				t.Fatal(err)
+			}
+			if header.Alg != test.alg || header.Kid != test.kid {
+				t.Errorf("header is %+v, expected alg %s and kid %s", header, test.alg, test.kid)
+			}
+
+			sess, err := s.check(context.Background(), token)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(sess.data) != 2 || sess.data["user"] != "alice" || sess.data["role"] != "admin" {
+				t.Errorf("session data is %v, registered claims must be removed", sess.data)
+			}
+			if !sess.expire.Equal(expire.Truncate(time.Second)) {
+				t.Errorf("expire is %v, expected %v", sess.expire, expire)
+			}
+		})
+	}
+}
+
+func TestJWTParse(t *testing.T) {
+	keys := jwtTestKeysNew(t)
+	defer keys.remove()
+
+	s, err := jwtSessionsNew(keys.files, "hs", time.Hour, 0, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsOld := &jwtKey{alg: "RS256", private: keys.rsOld, hash: func() hash.Hash { return sha256.New() }}
+
+	now := time.Now()
+	claims := func(extra map[string]interface{}) map[string]interface{} {
+		res := map[string]interface{}{"user": "alice", jwtClaimExpire: now.Add(time.Hour).Unix()}
+		for key, val := range extra {
+			res[key] = val
+		}
+		return res
+	}
+	valid := func() string {
+		return jwtTestToken(t, s.keys["hs"], jwtHeader{Alg: "HS256", Typ: "JWT", Kid: "hs"}, claims(nil))
+	}
+
+	tests := []struct {
+		name  string
+		token func() string
+		valid bool
+	}{
+		{"valid", valid, true},
+		{"kid case", func() string {
+			return jwtTestToken(t, s.keys["hs"], jwtHeader{Alg: "HS256", Kid: "HS"}, claims(nil))
+		}, true},
+		{"verification only key", func() string {
+			return jwtTestToken(t, rsOld, jwtHeader{Alg: "RS256", Kid: "rsold"}, claims(nil))
+		}, true},
+		{"tampered payload", func() string {
+			parts := strings.Split(valid(), ".")
+			payload, _ := json.Marshal(claims(map[string]interface{}{"user": "mallory"}))
+			parts[1] = base64.RawURLEncoding.EncodeToString(payload)
+			return strings.Join(parts, ".")
+		}, false},
+		{"tampered header", func() string {
+			parts := strings.Split(valid(), ".")
+			header, _ := json.Marshal(jwtHeader{Alg: "HS256", Kid: "hs2"})
+			parts[0] = base64.RawURLEncoding.EncodeToString(header)
+			return strings.Join(parts, ".")
+		}, false},
+		{"tampered signature", func() string {
+			parts := strings.Split(valid(), ".")
+			sig, _ := base64.RawURLEncoding.DecodeString(parts[2])
+			sig[0] ^= 1
+			parts[2] = base64.RawURLEncoding.EncodeToString(sig)
+			return strings.Join(parts, ".")
+		}, false},
+		{"signed by other key", func() string {
+			return jwtTestToken(t, s.keys["hs2"], jwtHeader{Alg: "HS256", Kid: "hs"}, claims(nil))
+		}, false},
+		{"unknown kid", func() string {
+			return jwtTestToken(t, s.keys["hs"], jwtHeader{Alg: "HS256", Kid: "hs3"}, claims(nil))
+		}, false},
+		{"no kid", func() string {
+			return jwtTestToken(t, s.keys["hs"], jwtHeader{Alg: "HS256"}, claims(nil))
+		}, false},
+		{"alg mismatch", func() string {
+			return jwtTestToken(t, s.keys["rs"], jwtHeader{Alg: "RS512", Kid: "rs"}, claims(nil))
+		}, false},
+		{"public key as hmac secret", func() string {
+			pub, _ := x509.MarshalPKIXPublicKey(&keys.rsOld.PublicKey)
+			key := &jwtKey{alg: "HS256", secret: pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: pub})}
+			return jwtTestToken(t, key, jwtHeader{Alg: "HS256", Kid: "rsold"}, claims(nil))
+		}, false},
+		{"alg none", func() string {
+			parts := strings.Split(jwtTestToken(t, s.keys["hs"], jwtHeader{Alg: "none", Kid: "hs"}, claims(nil)), ".")
+			return parts[0] + "." + parts[1] + "."
+		}, false},
+		{"expired", func() string {
+			return jwtTestToken(t, s.keys["hs"], jwtHeader{Alg: "HS256", Kid: "hs"},
+				claims(map[string]interface{}{jwtClaimExpire: now.Add(-time.Minute).Unix()}))
+		}, false},
+		{"no expiration", func() string {
+			return jwtTestToken(t, s.keys["hs"], jwtHeader{Alg: "HS256", Kid: "hs"}, map[string]interface{}{"user": "alice"})
+		}, false},
+		{"invalid expiration", func() string {
+			return jwtTestToken(t, s.keys["hs"], jwtHeader{Alg: "HS256", Kid: "hs"},
+				claims(map[string]interface{}{jwtClaimExpire: "tomorrow"}))
+		}, false},
+		{"not yet valid", func() string {
+			return jwtTestToken(t, s.keys["hs"], jwtHeader{Alg: "HS256", Kid: "hs"},
+				claims(map[string]interface{}{"nbf": now.Add(time.Minute).Unix()}))
+		}, false},
+		{"already valid", func() string {
+			return jwtTestToken(t, s.keys["hs"], jwtHeader{Alg: "HS256", Kid: "hs"},
+				claims(map[string]interface{}{"nbf": now.Add(-time.Minute).Unix()}))
+		}, true},
+		{"two parts", func() string {
+			parts := strings.Split(valid(), ".")
+			return parts[0] + "." + parts[1]
+		}, false},
+		{"invalid base64", func() string {
+			return valid() + "!"
+		}, false},
+		{"empty", func() string {
+			return ""
+		}, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			claims, err := s.parse(test.token())
+			if test.valid {
+				if err != nil {
+					t.Fatalf("token is rejected: %v", err)
+				}
+				if claims["user"] != "alice" {
+					t.Errorf("claims are %v", claims)
+				}
+				return
+			}
+
+			if err != errSessionInvalid {
+				t.Errorf("error is %v, expected %v", err, errSessionInvalid)
+			}
+		})
+	}
+}
+
+func TestJWTECSignature(t *testing.T) {
+	keys := jwtTestKeysNew(t)
+	defer keys.remove()
+
+	tests := []struct {
+		kid  string
+		size int // size of r || s signature
+	}{
+		{"es256", 64},
+		{"es384", 96},
+		{"es512", 132},
+	}
+
+	for _, test := range tests {
+		t.Run(test.kid, func(t *testing.T) {
+			key, err := jwtKeyLoad(keys.files[test.kid])
+			if err != nil {
+				t.Fatal(err)
+			}
+			data := []byte("header.payload")
+
+			// r and s with leading zero bytes are padded to fixed size
+			for i := 0; i < 64; i++ {
+				sig, err := key.sign(data)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if len(sig) != test.size {
+					t.Fatalf("signature size is %d, expected %d", len(sig), test.size)
+				}
+				if !key.verify(data, sig) {
+					t.Fatal("signature is not verified")
+				}
+			}
+
+			sig, err := key.sign(data)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if key.verify([]byte("header.payload2"), sig) {
+				t.Error("signature of other data is verified")
+			}
+
+			// DER encoded and truncated signatures are rejected
+			priv := key.private.(*ecdsa.PrivateKey)
+			h := key.hash()
+			h.Write(data)
+			r, s, err := ecdsa.Sign(rand.Reader, priv, h.Sum(nil))
+			if err != nil {
+				t.Fatal(err)
+			}
+			der, err := asn1.Marshal(struct{ R, S *big.Int }{r, s})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if key.verify(data, der) {
+				t.Error("DER signature is verified")
+			}
+			if key.verify(data, sig[1:]) || key.verify(data, append(sig, 0)) {
+				t.Error("signature of wrong size is verified")
+			}
+
+			// s and r swapped
+			half := test.size / 2
+			swapped := append(append([]byte{}, sig[half:]...), sig[:half]...)
+			if key.verify(data, swapped) {
+				t.Error("swapped signature is verified")
+			}
+		})
+	}
+}
@@ -0,0 +1,336 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var errConcurrencyLimited = errors.New("Too many concurrent executions of query")
+
+// rate limit exceeded, retry is a time until the next token
+type rateLimitError struct {
+	retry time.Duration
+}
+
+func (e *rateLimitError) Error() string {
+	return "Query rate limit exceeded"
+}
+
+// limiter key type
+type limitKey int
+
+const (
+	limitKeySession limitKey = iota // session key, client ip if there is no session
+	limitKeyIP                      // client ip
+	limitKeyGlobal                  // all clients
+)
+
+func (k limitKey) String() string {
+	return [...]string{"session", "ip", "global"}[k]
+}
+
+func (k *limitKey) parse(str string) error {
+	switch str {
+	case limitKeySession.String():
+		*k = limitKeySession
+	case limitKeyIP.String():
+		*k = limitKeyIP
+	case limitKeyGlobal.String():
+		*k = limitKeyGlobal
+	default:
+		return errors.New("Invalid limit key: " + str)
+	}
+	return nil
+}
+
+// limits of query
+type limitConfig struct {
+	rate       float64 // requests per second, 0 is unlimited
+	burst      int     // bucket size
+	concurrent int     // max concurrent executions, 0 is unlimited
+	key        limitKey
+}
+
+func (c limitConfig) String() string {
+	if c.rate <= 0 && c.concurrent <= 0 {
+		return "none"
+	}
+
+	var res []string
+	if c.rate > 0 {
+		res = append(res, fmt.Sprintf("rate=%v, burst=%d", c.rate, c.bucketSize()))
+	}
+	if c.concurrent > 0 {
+		res = append(res, fmt.Sprintf("concurrent=%d", c.concurrent))
+	}
+	return strings.Join(append(res, "key="+c.key.String()), ", ")
+}
+
+// burst is at least one request and a second of rate by default
+func (c limitConfig) bucketSize() int {
+	if c.burst > 0 {
+		return c.burst
+	}
+	return int(math.Max(1, math.Ceil(c.rate)))
+}
+
+// limits directive, fields override global config
+type queryLimits struct {
+	rate       *float64
+	burst      *int
+	concurrent *int
+	key        *limitKey
+}
+
+func (l queryLimits) String() string {
+	var res []string
+	if l.rate != nil {
+		res = append(res, fmt.Sprintf("rate=%v", *l.rate))
+	}
+	if l.burst != nil {
+		res = append(res, fmt.Sprintf("burst=%d", *l.burst))
+	}
+	if l.concurrent != nil {
+		res = append(res, fmt.Sprintf("concurrent=%d", *l.concurrent))
+	}
+	if l.key != nil {
+		res = append(res, "key="+l.key.String())
+	}
+
+	if len(res) == 0 {
+		return "Default"
+	}
+	return strings.Join(res, ", ")
+}
+
+// parse limit directive: comma separated rate=, burst=, concurrent=, key= values
+func (l *queryLimits) parse(str string) error {
+	var res queryLimits
+	for _, item := range strings.Split(str, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+
+		kv := strings.SplitN(item, "=", 2)
+		if len(kv) != 2 {
+			return errors.New("Invalid limit: " + item)
+		}
+
+		name, value := strings.ToLower(strings.TrimSpace(kv[0])), strings.ToLower(strings.TrimSpace(kv[1]))
+		switch name {
+		case "rate":
+			rate, err := strconv.ParseFloat(value, 64)
+			if err != nil {
+				return err
+			}
+			res.rate = &rate
+		case "burst", "concurrent":
+			num, err := strconv.Atoi(value)
+			if err != nil {
+				return err
+			}
+			if name == "burst" {
+				res.burst = &num
+			} else {
+				res.concurrent = &num
+			}
+		case "key":
+			var key limitKey
+			if err := key.parse(value); err != nil {
+				return err
+			}
+			res.key = &key
+		default:
+			return errors.New("Unknown limit: " + name)
+		}
+	}
+
+	*l = res
+	return nil
+}
+
+// query limits over global config
+func (c limitConfig) merge(l queryLimits) limitConfig {
+	if l.rate != nil {
+		c.rate = *l.rate
+	}
+	if l.burst != nil {
+		c.burst = *l.burst
+	}
+	if l.concurrent != nil {
+		c.concurrent = *l.concurrent
+	}
+	if l.key != nil {
+		c.key = *l.key
+	}
+	return c
+}
+
+// token bucket and concurrent executions counter
+type limitBucket struct {
+	query  string
+	key    string
+	tokens float64
+	last   time.Time // last refill
+	active int
+}
+
+type limiter struct {
+	config          limitConfig // global limits
+	buckets         map[string]*limitBucket
+	lock            *sync.Mutex
+	contextCancelFn context.CancelFunc
+	wg              sync.WaitGroup
+}
+
+func limiterNew(ctx context.Context, config limitConfig) *limiter {
+	var l limiter
+	l.config = config
+	l.buckets = make(map[string]*limitBucket)
+	l.lock = new(sync.Mutex)
+
+	var gcContext context.Context
+	gcContext, l.contextCancelFn = context.WithCancel(ctx)
+
+	// run buckets GC
+	l.wg.Add(1)
+	go l.gc(gcContext)
+
+	return &l
+}
+
+// delete idle buckets, full bucket is the same as absent one
+const limiterGCPeriod = time.Minute
+
+func (l *limiter) gc(ctx context.Context) {
+	defer l.wg.Done()
+	timer := time.NewTicker(limiterGCPeriod)
+	defer timer.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-timer.C:
+			now := time.Now()
+			l.lock.Lock()
+			for key, bucket := range l.buckets {
+				if bucket.active == 0 && now.Sub(bucket.last) > limiterGCPeriod {
+					delete(l.buckets, key)
+				}
+			}
+			l.lock.Unlock()
+		}
+	}
+}
+
+// limiter key value of request
+func (l *limiter) keyValue(req *http.Request, client string, key limitKey) string {
+	switch key {
+	case limitKeyGlobal:
+		return key.String()
+	case limitKeySession:
+		// client of validated API key, certificate or session
+		if client != "" {
+			return client
+		}
+	}
+
+	return limitKeyIP.String() + ":" + clientIP(req)
+}
+
+// global limits
+func (l *limiter) getConfig() limitConfig {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return l.config
+}
+
+func (l *limiter) setConfig(config limitConfig) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.config = config
+}
+
+// take token and execution slot of query, client is authorized client or empty string, release must be called after execution
+func (l *limiter) acquire(req *http.Request, client string, q *query) (func(), error) {
+	config := l.getConfig().merge(q.limits)
+	if config.rate <= 0 && config.concurrent <= 0 {
+		return func() {}, nil
+	}
+
+	key := l.keyValue(req, client, config.key)
+	name := q.name + "\x00" + key
+	now := time.Now()
+	size := float64(config.bucketSize())
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	bucket, ok := l.buckets[name]
+	if !ok {
+		bucket = &limitBucket{query: q.name, key: key, tokens: size, last: now}
+		l.buckets[name] = bucket
+	}
+
+	if config.concurrent > 0 && bucket.active >= config.concurrent {
+		return nil, errConcurrencyLimited
+	}
+
+	if config.rate > 0 {
+		bucket.tokens = math.Min(size, bucket.tokens+now.Sub(bucket.last).Seconds()*config.rate)
+		bucket.last = now
+		if bucket.tokens < 1 {
+			return nil, &rateLimitError{time.Duration((1 - bucket.tokens) / config.rate * float64(time.Second))}
+		}
+		bucket.tokens--
+	}
+
+	bucket.active++
+	bucket.last = now
+	return func() {
+		l.lock.Lock()
+		defer l.lock.Unlock()
+		bucket.active--
+	}, nil
+}
+
+// limiter state of admin endpoint
+type limitState struct {
+	Query  string  `json:"query"`
+	Key    string  `json:"key"`
+	Tokens float64 `json:"tokens"`
+	Active int     `json:"active"`
+}
+
+func (l *limiter) state() []limitState {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	res := make([]limitState, 0, len(l.buckets))
+	for _, bucket := range l.buckets {
+		res = append(res, limitState{Query: bucket.query, Key: bucket.key, Tokens: bucket.tokens, Active: bucket.active})
+	}
+	sort.Slice(res, func(i, j int) bool {
+		if res[i].Query != res[j].Query {
+			return res[i].Query < res[j].Query
+		}
+		return res[i].Key < res[j].Key
+	})
+
+	return res
+}
+
+// stop gc worker
+func (l *limiter) stop() {
+	l.contextCancelFn()
+	l.wg.Wait()
+}
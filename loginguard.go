@@ -0,0 +1,212 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+var errLoginLocked = errors.New("Too many failed login attempts")
+
+// failed login attempts counter
+type loginCounter struct {
+	failures    int
+	last        time.Time // last failure
+	lockedUntil time.Time
+}
+
+// login brute-force protection, counts failures by client ip and login param value
+type loginGuard struct {
+	counters        map[string]*loginCounter
+	lock            *sync.Mutex
+	attempts        int           // failures before lockout
+	backoff         time.Duration // first lockout duration, doubled on each next failure
+	maxBackoff      time.Duration
+	window          time.Duration // counter is reset after window without failures
+	loginParam      string
+	contextCancelFn context.CancelFunc
+	wg              sync.WaitGroup
+}
+
+func loginGuardNew(ctx context.Context, attempts int, backoff time.Duration, maxBackoff time.Duration, window time.Duration, loginParam string) *loginGuard {
+	var g loginGuard
+	g.counters = make(map[string]*loginCounter)
+	g.lock = new(sync.Mutex)
+	g.attempts = attempts
+	g.backoff = backoff
+	g.maxBackoff = maxBackoff
+	g.window = window
+	g.loginParam = loginParam
+
+	var gcContext context.Context
+	gcContext, g.contextCancelFn = context.WithCancel(ctx)
+
+	// run counters GC
+	g.wg.Add(1)
+	go g.gc(gcContext)
+
+	return &g
+}
+
+// delete stale counters
+func (g *loginGuard) gc(ctx context.Context) {
+	defer g.wg.Done()
+	period := g.window
+	if period <= 0 {
+		period = time.Minute
+	}
+	timer := time.NewTicker(period)
+	defer timer.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-timer.C:
+			now := time.Now()
+			g.lock.Lock()
+			for key, counter := range g.counters {
+				if now.After(counter.lockedUntil) && now.Sub(counter.last) > g.window {
+					delete(g.counters, key)
+				}
+			}
+			g.lock.Unlock()
+		}
+	}
+}
+
+// counter keys of login request
+func (g *loginGuard) keys(req *http.Request, params queryParams) []string {
+	keys := []string{"ip:" + clientIP(req)}
+	if g.loginParam != "" {
+		if login, ok := params.stringValue(g.loginParam); ok && login != "" {
+			keys = append(keys, "login:"+strings.ToLower(login))
+		}
+	}
+	return keys
+}
+
+// login attempt reserved on counter key
+type loginReserve struct {
+	key         string
+	counter     *loginCounter
+	lockedUntil time.Time // lockout set by the attempt, zero if there is no one
+	prevLocked  time.Time // lockout before the attempt
+}
+
+// Reserve login attempt, it is counted as failure until it is refunded, so parallel attempts can't pass the limit.
+// Returns time to wait before the next attempt if the client is locked, then nothing is reserved.
+func (g *loginGuard) reserve(keys []string) ([]loginReserve, time.Duration) {
+	now := time.Now()
+	g.lock.Lock()
+	defer g.lock.Unlock()
+
+	var wait time.Duration
+	for _, key := range keys {
+		if counter, ok := g.counters[key]; ok && counter.lockedUntil.After(now) {
+			if d := counter.lockedUntil.Sub(now); d > wait {
+				wait = d
+			}
+		}
+	}
+	if wait > 0 {
+		return nil, wait
+	}
+
+	res := make([]loginReserve, 0, len(keys))
+	for _, key := range keys {
+		counter, ok := g.counters[key]
+		if !ok || now.Sub(counter.last) > g.window {
+			counter = &loginCounter{}
+			g.counters[key] = counter
+		}
+		counter.failures++
+		counter.last = now
+
+		r := loginReserve{key: key, counter: counter, prevLocked: counter.lockedUntil}
+		if counter.failures >= g.attempts {
+			// lockout is doubled on each failure after attempts limit
+			lockout := g.backoff
+			for i := g.attempts; i < counter.failures && lockout < g.maxBackoff; i++ {
+				lockout *= 2
+			}
+			if lockout > g.maxBackoff {
+				lockout = g.maxBackoff
+			}
+			counter.lockedUntil = now.Add(lockout)
+			r.lockedUntil = counter.lockedUntil
+		}
+		res = append(res, r)
+	}
+
+	return res, 0
+}
+
+// failed attempt stays counted
+func (g *loginGuard) fail(res []loginReserve) {
+	for _, r := range res {
+		if !r.lockedUntil.IsZero() {
+			log.Printf("Login lockout of %s until %s after %d failed attempts\n", r.key, r.lockedUntil.Format(time.RFC3339), r.counter.failures)
+		}
+	}
+}
+
+// attempt is not a failure, for example database is unavailable
+func (g *loginGuard) refund(res []loginReserve) {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+
+	for _, r := range res {
+		g.refundKey(r)
+	}
+}
+
+// reset login counter on success, ip counter is only refunded, so own valid login doesn't reset it
+func (g *loginGuard) success(res []loginReserve) {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+
+	for _, r := range res {
+		if strings.HasPrefix(r.key, "login:") {
+			if g.counters[r.key] == r.counter {
+				delete(g.counters, r.key)
+			}
+			continue
+		}
+		g.refundKey(r)
+	}
+}
+
+func (g *loginGuard) refundKey(r loginReserve) {
+	// counter was reset or deleted by gc
+	if g.counters[r.key] != r.counter {
+		return
+	}
+
+	if r.counter.failures > 0 {
+		r.counter.failures--
+	}
+	// lockout of the attempt is cancelled, if a later attempt has not replaced it
+	if !r.lockedUntil.IsZero() && r.counter.lockedUntil.Equal(r.lockedUntil) {
+		r.counter.lockedUntil = r.prevLocked
+	}
+}
+
+// stop gc worker
+func (g *loginGuard) stop() {
+	g.contextCancelFn()
+	g.wg.Wait()
+}
+
+// client ip address without port
+func clientIP(req *http.Request) string {
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		return req.RemoteAddr
+	}
+	return host
+}
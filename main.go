@@ -20,13 +20,23 @@ const defaultCfg = "default.toml"
 func main() {
 	isChild := flag.Bool("child", false, "Run as child. (Do not use this flag. It is needed to restart the service.)")
 	cfgFile := flag.String("cfg", defaultCfg, "Configuration file")
+	newAPIKey := flag.Bool("apikey", false, "Generate a new API key, print it and its hash and exit")
 	flag.Parse()
 
+	if *newAPIKey {
+		key, hash, err := apiKeyGenerate()
+		if err != nil {
+			log.Fatalln(err)
+		}
+		fmt.Printf("key:  %s\nhash: %s\n", key, hash)
+		return
+	}
+
 	log.SetPrefix(fmt.Sprintf("pgmusql PID(%d):", syscall.Getpid()))
 
 	sgnl := make(chan os.Signal, 1)
 	defer close(sgnl)
-	signal.Notify(sgnl, syscall.SIGUSR1, syscall.SIGTERM, syscall.SIGINT)
+	signal.Notify(sgnl, syscall.SIGUSR1, syscall.SIGTERM, syscall.SIGINT, syscall.SIGHUP)
 
 	// create and run server
 	var err error
@@ -57,6 +67,9 @@ func main() {
 		case syscall.SIGTERM:
 			srv.terminate()
 			os.Exit(66)
+		// reload certificate and config
+		case syscall.SIGHUP:
+			srv.reload()
 		// start child server
 		case syscall.SIGUSR1:
 			cmd := exec.Command(os.Args[0], "-child")
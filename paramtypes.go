@@ -0,0 +1,214 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Input param type declared in the "in" directive
+type paramType struct {
+	name  string                            // declared type name
+	cast  string                            // postgres type used in query cast
+	array bool                              // array of base type
+	elem  reflect.Type                      // go type of converted value
+	conv  func(string) (interface{}, error) // string to value converter
+}
+
+type paramBaseType struct {
+	cast string
+	elem reflect.Type
+	conv func(string) (interface{}, error)
+}
+
+var (
+	typeString = reflect.TypeOf("")
+	typeInt    = reflect.TypeOf(int64(0))
+	typeFloat  = reflect.TypeOf(float64(0))
+	typeBool   = reflect.TypeOf(false)
+	typeTime   = reflect.TypeOf(time.Time{})
+)
+
+// available param types
+var paramBaseTypes = map[string]paramBaseType{
+	"text":        {"text", typeString, convText},
+	"varchar":     {"varchar", typeString, convText},
+	"smallint":    {"int2", typeInt, convInt(16)},
+	"int2":        {"int2", typeInt, convInt(16)},
+	"int":         {"int4", typeInt, convInt(32)},
+	"integer":     {"int4", typeInt, convInt(32)},
+	"int4":        {"int4", typeInt, convInt(32)},
+	"bigint":      {"int8", typeInt, convInt(64)},
+	"int8":        {"int8", typeInt, convInt(64)},
+	"numeric":     {"numeric", typeString, convNumeric},
+	"decimal":     {"numeric", typeString, convNumeric},
+	"real":        {"float4", typeFloat, convFloat(32)},
+	"float4":      {"float4", typeFloat, convFloat(32)},
+	"float":       {"float8", typeFloat, convFloat(64)},
+	"float8":      {"float8", typeFloat, convFloat(64)},
+	"bool":        {"bool", typeBool, convBool},
+	"boolean":     {"bool", typeBool, convBool},
+	"date":        {"date", typeTime, convTime("2006-01-02")},
+	"timestamp":   {"timestamp", typeTime, convTime(time.RFC3339Nano, "2006-01-02T15:04:05", "2006-01-02 15:04:05", "2006-01-02")},
+	"timestamptz": {"timestamptz", typeTime, convTime(time.RFC3339Nano, "2006-01-02 15:04:05Z07:00", "2006-01-02T15:04:05", "2006-01-02 15:04:05", "2006-01-02")},
+	"uuid":        {"uuid", typeString, convUUID},
+	"json":        {"json", typeString, convJSON},
+	"jsonb":       {"jsonb", typeString, convJSON},
+}
+
+// parse type declaration like "int" or "text[]"
+var errParamTypeUnknown = errors.New("Unknown param type")
+
+// pgx has no encoder of json arrays
+var errParamTypeJSONArray = errors.New("Arrays of json are not supported")
+
+func paramTypeParse(str string) (*paramType, error) {
+	name := strings.ToLower(str)
+	array := strings.HasSuffix(name, "[]")
+
+	base, ok := paramBaseTypes[strings.TrimSuffix(name, "[]")]
+	if !ok {
+		return nil, errParamTypeUnknown
+	}
+	if array && (base.cast == "json" || base.cast == "jsonb") {
+		return nil, errParamTypeJSONArray
+	}
+
+	t := paramType{
+		name:  name,
+		cast:  base.cast,
+		array: array,
+		elem:  base.elem,
+		conv:  base.conv,
+	}
+	if array {
+		t.cast += "[]"
+	}
+
+	return &t, nil
+}
+
+// convert request values to query argument
+func (t *paramType) convert(vals []string) (interface{}, error) {
+	if !t.array {
+		return t.conv(vals[0])
+	}
+
+	res := reflect.MakeSlice(reflect.SliceOf(t.elem), 0, len(vals))
+	for i, str := range vals {
+		val, err := t.conv(str)
+		if err != nil {
+			return nil, fmt.Errorf("element %d: %v", i+1, err)
+		}
+		res = reflect.Append(res, reflect.ValueOf(val))
+	}
+
+	return res.Interface(), nil
+}
+
+// text param keeps empty string value, nil is untyped param
+func (t *paramType) isText() bool {
+	return t == nil || (!t.array && t.elem == typeString && (t.cast == "text" || t.cast == "varchar"))
+}
+
+func (t *paramType) isJSON() bool {
+	return t != nil && (t.cast == "json" || t.cast == "jsonb")
+}
+
+// converters
+func convText(str string) (interface{}, error) {
+	return str, nil
+}
+
+func convInt(bitSize int) func(string) (interface{}, error) {
+	return func(str string) (interface{}, error) {
+		val, err := strconv.ParseInt(strings.TrimSpace(str), 10, bitSize)
+		if err != nil {
+			return nil, fmt.Errorf("%q is not a valid %d bit integer", str, bitSize)
+		}
+		return val, nil
+	}
+}
+
+func convFloat(bitSize int) func(string) (interface{}, error) {
+	return func(str string) (interface{}, error) {
+		val, err := strconv.ParseFloat(strings.TrimSpace(str), bitSize)
+		if err != nil {
+			return nil, fmt.Errorf("%q is not a valid float", str)
+		}
+		return val, nil
+	}
+}
+
+func convNumeric(str string) (interface{}, error) {
+	str = strings.TrimSpace(str)
+	if _, ok := new(big.Float).SetString(str); !ok {
+		return nil, fmt.Errorf("%q is not a valid numeric", str)
+	}
+	return str, nil
+}
+
+func convBool(str string) (interface{}, error) {
+	val, err := strconv.ParseBool(strings.TrimSpace(str))
+	if err != nil {
+		return nil, fmt.Errorf("%q is not a valid boolean", str)
+	}
+	return val, nil
+}
+
+func convTime(layouts ...string) func(string) (interface{}, error) {
+	return func(str string) (interface{}, error) {
+		for _, layout := range layouts {
+			if val, err := time.Parse(layout, strings.TrimSpace(str)); err == nil {
+				return val, nil
+			}
+		}
+		return nil, fmt.Errorf("%q is not a valid date/time, expected format %s", str, layouts[0])
+	}
+}
+
+func convUUID(str string) (interface{}, error) {
+	val, err := uuid.Parse(strings.TrimSpace(str))
+	if err != nil {
+		return nil, fmt.Errorf("%q is not a valid uuid", str)
+	}
+	return val.String(), nil
+}
+
+func convJSON(str string) (interface{}, error) {
+	if !json.Valid([]byte(str)) {
+		return nil, fmt.Errorf("%q is not a valid json", str)
+	}
+	return str, nil
+}
+
+// invalid input param value error
+type paramError struct {
+	name string
+	err  error
+}
+
+func (e *paramError) Error() string {
+	return fmt.Sprintf("Invalid value of parameter %s: %v", e.name, e.err)
+}
+
+// missing required params error
+type paramsMissingError []string
+
+func (e paramsMissingError) Error() string {
+	return "Missing required parameters: " + strings.Join(e, ", ")
+}
+
+// undeclared params error
+type paramsUnknownError []string
+
+func (e paramsUnknownError) Error() string {
+	return "Unknow input parameters: " + strings.Join(e, ", ")
+}
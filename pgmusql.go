@@ -2,13 +2,21 @@ package main
 
 import (
 	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"log"
+	"mime"
 	"net"
 	"net/http"
-	"net/url"
 	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
@@ -19,34 +27,53 @@ const (
 	srvcSQLURL              = "/sql/"
 	srvcLoginURL            = "/login"
 	srvcLogoutURL           = "/logout"
+	srvcRefreshURL          = "/refresh"
 	srvcDocURL              = "/doc"
+	srvcLimitsURL           = "/admin/limits"
 	srvcExpectedContentType = "application/x-www-form-urlencoded"
+	srvcJSONContentType     = "application/json"
 	srvcOutputContentType   = "application/json;charset=UTF-8"
 	srvcOutputHTMLType      = "text/html; charset=utf-8"
 	srvcCfgPath             = "."
 	srvcCfgName             = "config"
 	srvcAuthCookieName      = "Authorization"
+	srvcMaxBodySize         = 10 << 20 // json body limit, the same as form limit of ParseForm
 )
 
 type pgmusql struct {
-	httpsrv       *http.Server
-	startTime     time.Time
-	cfg           *viper.Viper
-	queries       map[string]*query
-	db            *database
-	parser        *sqlParser
-	timeout       time.Duration
-	socketFile    *os.File
-	listener      net.Listener
-	mainContext   context.Context
-	sessions      *sessions
-	keepalive     bool
-	loginRequired bool
-	loginQuery    string
-	logoutQuery   string
-	cookieSession bool
-	useTLS        bool
-	sqlTreeView   *sqlTreeViewNode
+	httpsrv          *http.Server
+	startTime        time.Time
+	cfg              *viper.Viper
+	cfgFile          string
+	applied          map[string]string // applied config settings, updated on reload
+	options          atomic.Value      // srvcOptions, can be changed on reload
+	certs            *certReloader
+	queries          map[string]*query
+	queriesLock      *sync.RWMutex
+	db               *database            // dburl database, also used by session and API key stores
+	dbs              map[string]*database // databases by name, including default
+	parser           *sqlParser
+	socketFile       *os.File
+	listener         net.Listener
+	mainContext      context.Context
+	sessions         sessionManager
+	loginRequired    bool
+	accessRoleColumn string
+	loginGuard       *loginGuard
+	limiter          *limiter
+	adminAccess      queryAccess
+	loginQuery       string
+	logoutQuery      string
+	cookieSession    bool
+	sameSite         http.SameSite
+	csrf             *csrfGuard  // nil if csrf protection is disabled
+	apiKeys          apiKeyStore // nil if API keys are disabled
+	apiKeyHeader     string
+	clientIdentity   string // client certificate field of identity
+	useTLS           bool
+	sqlTreeView      *sqlTreeViewNode
+	docEnable        bool
+	watcher          *sqlWatcher
 }
 
 // create pgmusql service
@@ -59,20 +86,42 @@ func pgmusqlNew(ctx context.Context, isChild bool, cfgFile string) (*pgmusql, er
 	}
 
 	// sort of config
-	p.timeout = p.cfg.GetDuration("querytimeout")
-	p.keepalive = p.cfg.GetBool("keepalive")
+	p.cfgFile = cfgFile
+	p.applied = cfgFlatten(p.cfg)
+	p.options.Store(srvcOptionsFromCfg(p.cfg))
 	p.loginRequired = p.cfg.GetBool("loginrequired")
+	p.accessRoleColumn = p.cfg.GetString("accessrolecolumn")
 	p.cookieSession = p.cfg.GetBool("cookiesession")
 	p.useTLS = p.cfg.GetBool("usetls")
+	if p.sameSite, err = cookieSameSite(p.cfg.GetString("cookiesamesite")); err != nil {
+		return nil, err
+	}
+	if p.sameSite == http.SameSiteNoneMode && !p.useTLS {
+		log.Println("SameSite=None cookie is rejected by browsers without usetls")
+	}
+	if p.cookieSession && p.cfg.GetBool("csrfprotection") {
+		persistent := p.loginRequired && (strings.ToLower(p.cfg.GetString("sessiontype")) == "jwt" || strings.ToLower(p.cfg.GetString("sessionstore")) != "memory")
+		if p.csrf, err = csrfGuardNew(p.cfg.GetString("csrfsecret"), persistent); err != nil {
+			return nil, err
+		}
+	}
+	p.docEnable = p.cfg.GetBool("docenable")
 	p.mainContext = ctx
+	p.queriesLock = new(sync.RWMutex)
 
-	// connect to db
-	if p.db, err = dbNew(p.cfg.GetString("dburl"), p.cfg.GetBool("filteroutparams"), p.cfg.GetBool("filterinparams"), p.cfg.GetBool("mutedberrors")); err != nil {
+	// connect to databases
+	if p.dbs, err = databasesNew(ctx, p.cfg); err != nil {
 		return nil, err
 	}
+	p.db = p.dbs[dbDefaultName]
 
 	// create parser
-	if p.parser, err = sqlParserNew(); err != nil {
+	dbNames := databaseNames(p.dbs)
+	dbDirs := databaseDirs(p.cfg.GetStringMapString("databasedirs"))
+	if err = dbDirs.check(dbNames); err != nil {
+		return nil, err
+	}
+	if p.parser, err = sqlParserNew(dbDirs, dbNames); err != nil {
 		return nil, err
 	}
 
@@ -102,26 +151,61 @@ func pgmusqlNew(ctx context.Context, isChild bool, cfgFile string) (*pgmusql, er
 
 	// create sessions list
 	if p.loginRequired {
-		p.sessions = sessionsNew(p.mainContext, p.cfg.GetDuration("sessionlifetime"))
+		var store sessionStore
+		if store, err = sessionStoreNew(ctx, p.cfg.GetString("sessionstore"), p.db.pool, p.cfg.GetString("sessiontable"), p.cfg.GetString("sessiondir")); err != nil {
+			return nil, err
+		}
+		if p.sessions, err = p.sessionsNew(store); err != nil {
+			return nil, err
+		}
+		if attempts := p.cfg.GetInt("loginattempts"); attempts > 0 {
+			p.loginGuard = loginGuardNew(p.mainContext, attempts, p.cfg.GetDuration("loginbackoff"), p.cfg.GetDuration("loginmaxbackoff"), p.cfg.GetDuration("loginattemptswindow"), p.cfg.GetString("loginparam"))
+		}
 		p.loginQuery = p.cfg.GetString("loginquery")
 		p.logoutQuery = p.cfg.GetString("logoutquery")
 		mu.HandleFunc(srvcLoginURL, p.loginHandler)
 		mu.HandleFunc(srvcLogoutURL, p.logoutHandler)
+		mu.HandleFunc(srvcRefreshURL, p.refreshHandler)
 	}
 
-	if p.cfg.GetBool("docenable") {
+	// API keys
+	if store := p.cfg.GetString("apikeystore"); store != "" {
+		if p.apiKeys, err = apiKeyStoreNew(ctx, store, p.db.pool, p.cfg.GetString("apikeyfile"), p.cfg.GetString("apikeytable")); err != nil {
+			return nil, err
+		}
+		p.apiKeyHeader = p.cfg.GetString("apikeyheader")
+	}
+
+	// create limiter
+	limits, err := limitConfigFromCfg(p.cfg)
+	if err != nil {
+		return nil, err
+	}
+	p.limiter = limiterNew(p.mainContext, limits)
+
+	// admin endpoints
+	if p.cfg.GetBool("adminenable") {
+		if err = p.adminAccess.parse(p.cfg.GetString("adminaccess")); err != nil {
+			return nil, fmt.Errorf("adminaccess: %w", err)
+		}
+		mu.HandleFunc(srvcLimitsURL, p.limitsHandler)
+	}
+
+	if p.docEnable {
 		mu.HandleFunc(srvcDocURL, p.docHandler)
 		// delete this
 
 		mu.Handle("/html/", http.StripPrefix("/html", http.FileServer(http.Dir("./html"))))
 
 		// end
-		p.sqlTreeView = newSQLTreeView()
-		for _, query := range p.queries {
-			p.sqlTreeView.add(srvcDocURL, query)
-		}
-		p.sqlTreeView.sort()
+		p.setQueries(p.queries)
+	}
 
+	// watch sql files
+	if p.cfg.GetBool("hotreload") {
+		if p.watcher, err = sqlWatcherNew(p.mainContext, &p, sqlroot, p.cfg.GetDuration("hotreloaddelay"), p.cfg.GetBool("hotreloadtest")); err != nil {
+			return nil, err
+		}
 	}
 
 	p.httpsrv = &http.Server{
@@ -129,6 +213,25 @@ func pgmusqlNew(ctx context.Context, isChild bool, cfgFile string) (*pgmusql, er
 		Handler: mu,
 	}
 
+	// client certificates verification
+	if caFile := p.cfg.GetString("clientca"); p.useTLS && caFile != "" {
+		if p.httpsrv.TLSConfig, err = tlsClientConfig(caFile, p.cfg.GetString("clientauth")); err != nil {
+			return nil, err
+		}
+		p.clientIdentity = p.cfg.GetString("clientidentity")
+	}
+
+	// server certificate is reloaded on SIGHUP
+	if p.useTLS {
+		if p.certs, err = certReloaderNew(p.cfg.GetString("certfile"), p.cfg.GetString("keyfile")); err != nil {
+			return nil, err
+		}
+		if p.httpsrv.TLSConfig == nil {
+			p.httpsrv.TLSConfig = &tls.Config{}
+		}
+		p.httpsrv.TLSConfig.GetCertificate = p.certs.getCertificate
+	}
+
 	// init socket file and listener or inherit its
 	if isChild {
 		p.socketFile = os.NewFile(uintptr(3), "socketFile")
@@ -156,7 +259,7 @@ func (srvc *pgmusql) start() error {
 	log.Println("Start server")
 
 	if srvc.useTLS {
-		return srvc.httpsrv.ServeTLS(srvc.listener, srvc.cfg.GetString("certfile"), srvc.cfg.GetString("keyfile"))
+		return srvc.httpsrv.ServeTLS(srvc.listener, "", "")
 	}
 
 	return srvc.httpsrv.Serve(srvc.listener)
@@ -173,15 +276,25 @@ func (srvc *pgmusql) stop() {
 		defer cancelFn()
 	}
 
-	defer srvc.db.close()
+	defer databasesClose(srvc.dbs)
 	if err := srvc.httpsrv.Shutdown(ctx); err != nil {
 		log.Println(err)
 	}
 
+	if srvc.watcher != nil {
+		srvc.watcher.stop()
+	}
+
 	if srvc.loginRequired {
 		srvc.sessions.gcStop()
 	}
 
+	if srvc.loginGuard != nil {
+		srvc.loginGuard.stop()
+	}
+
+	srvc.limiter.stop()
+
 	log.Println("Server stop complete")
 }
 
@@ -192,57 +305,128 @@ func (srvc *pgmusql) terminate() {
 		log.Println(err)
 	}
 
+	if srvc.watcher != nil {
+		srvc.watcher.stop()
+	}
+
 	if srvc.loginRequired {
 		srvc.sessions.gcStop()
 	}
 
+	if srvc.loginGuard != nil {
+		srvc.loginGuard.stop()
+	}
+
+	srvc.limiter.stop()
+
 	log.Println("Sever termination complete")
 }
 
+// get query by name
+func (srvc *pgmusql) getQuery(queryname string) (*query, bool) {
+	srvc.queriesLock.RLock()
+	defer srvc.queriesLock.RUnlock()
+	query, found := srvc.queries[queryname]
+	return query, found
+}
+
+// replace query list and doc tree view
+func (srvc *pgmusql) setQueries(queries map[string]*query) {
+	var treeView *sqlTreeViewNode
+	if srvc.docEnable {
+		treeView = newSQLTreeView()
+		for _, query := range queries {
+			treeView.add(srvcDocURL, query)
+		}
+		treeView.sort()
+	}
+
+	srvc.queriesLock.Lock()
+	defer srvc.queriesLock.Unlock()
+	srvc.queries = queries
+	srvc.sqlTreeView = treeView
+}
+
 // execute query function
 var errQueryTimeout = errors.New("Query timeout")
 var errQueryContexDone = errors.New("Context done")
 var errQueryNotFound = errors.New("Query not found")
 
-func (srvc *pgmusql) runQuery(ctx context.Context, queryname string, params url.Values, limit int) ([]byte, int, error) {
-	// search query for address
-	query, found := srvc.queries[queryname]
+func (srvc *pgmusql) runQuery(ctx context.Context, queryname string, params queryParams, limit int) ([]byte, int, error) {
+	query, err := srvc.findQuery(queryname)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return srvc.execQuery(ctx, query, params, formatJSON, limit)
+}
+
+// search query for address
+func (srvc *pgmusql) findQuery(queryname string) (*query, error) {
+	return queryUsable(srvc.getQuery(queryname))
+}
+
+// found query without load or autotest error
+func queryUsable(query *query, found bool) (*query, error) {
 	if !found {
-		return nil, 0, errQueryNotFound
+		return nil, errQueryNotFound
 	}
-	// error during autotest
+	// error during loading or autotest
 	if query.err != nil {
-		return nil, 0, query.err
+		return nil, query.err
 	}
 
-	// execute query
-	cancelCtx, ctxCancelFnc := context.WithCancel(ctx)
+	return query, nil
+}
+
+func (srvc *pgmusql) execQuery(ctx context.Context, query *query, params queryParams, format resultFormat, limit int) ([]byte, int, error) {
+	// execute query, context deadline cancels the statement on timeout
+	queryCtx, ctxCancelFnc := srvc.queryContext(ctx, query)
 	defer ctxCancelFnc()
 
-	timeout := time.After(srvc.timeout)
+	db, err := srvc.queryDatabase(query)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	res, total, err := db.query(queryCtx, *query, params, format, limit)
+	if err != nil {
+		return nil, 0, queryContextError(ctx, queryCtx, err)
+	}
+
+	return res, total, nil
+}
+
+// query context with timeout deadline
+func (srvc *pgmusql) queryContext(ctx context.Context, query *query) (context.Context, context.CancelFunc) {
+	timeout := srvc.opts().timeout
 	if query.timeout != nil {
-		timeout = time.After(*query.timeout)
+		timeout = *query.timeout
 	}
 
-	// handle result
-	select {
-	// cancel
-	case <-cancelCtx.Done():
-		return nil, 0, errQueryContexDone
-	// timeout
-	case <-timeout:
-		return nil, 0, errQueryTimeout
-	// ok
-	case response := <-srvc.db.queryChannel(cancelCtx, *query, params, limit):
-		if response.err != nil {
-			return nil, 0, response.err
-		}
-		return response.res, response.total, nil
+	if srvc.db.opts().statementTimeout {
+		timeout += statementTimeoutGrace
 	}
+
+	return context.WithTimeout(ctx, timeout)
+}
+
+// replace error caused by context cancel or timeout
+func queryContextError(ctx context.Context, queryCtx context.Context, err error) error {
+	switch {
+	case ctx.Err() != nil:
+		return errQueryContexDone
+	case queryCtx.Err() != nil:
+		return errQueryTimeout
+	}
+
+	return err
 }
 
 // parse session key
 var errNoSession = errors.New("No session key")
+var errSessionInvalid = errors.New("Session key is invalid")
+var errQueryProhibited = errors.New("Calling this query directly is prohibited")
 
 func (srvc *pgmusql) getAuthkey(req *http.Request) (string, error) {
 	var authkey string
@@ -252,8 +436,15 @@ func (srvc *pgmusql) getAuthkey(req *http.Request) (string, error) {
 			return "", err
 		}
 		authkey = cookie.Value
+
+		// browser sends cookie with cross-site requests, so the request must prove it is sent by our client
+		if srvc.csrf != nil && authkey != "" {
+			if err := srvc.csrf.check(req, authkey); err != nil {
+				return "", err
+			}
+		}
 	} else {
-		authkey = req.Header.Get("Authorization")
+		authkey = strings.TrimPrefix(req.Header.Get("Authorization"), "Bearer ")
 	}
 
 	if authkey == "" {
@@ -263,83 +454,270 @@ func (srvc *pgmusql) getAuthkey(req *http.Request) (string, error) {
 	return authkey, nil
 }
 
-// check request and prepare form data
-var errContentType = fmt.Errorf("Only %s content type allowed", srvcExpectedContentType)
+// create session manager by session type: uuid or jwt
+var errSessionType = errors.New("Unknown session type")
+
+func (p *pgmusql) sessionsNew(store sessionStore) (sessionManager, error) {
+	lifeTime := p.cfg.GetDuration("sessionlifetime")
+	maxLifeTime := p.cfg.GetDuration("sessionmaxlifetime")
 
-func (srvc *pgmusql) checkRequest(req *http.Request) (int, error) {
+	switch strings.ToLower(p.cfg.GetString("sessiontype")) {
+	case "uuid", "":
+		return sessionsNew(p.mainContext, lifeTime, maxLifeTime, p.cfg.GetBool("sessionsliding"), store), nil
+	case "jwt":
+		if p.cfg.GetBool("sessionsliding") {
+			log.Println("Sliding session expiration is not supported by jwt sessions, use /refresh")
+		}
+
+		// revoked tokens are stored in session store
+		var denylist *sessions
+		if p.cfg.GetBool("jwtdenylist") {
+			denylist = sessionsNew(p.mainContext, lifeTime, 0, false, store)
+		}
+
+		jwt, err := jwtSessionsNew(p.cfg.GetStringMapString("jwtkeys"), p.cfg.GetString("jwtkid"), lifeTime, maxLifeTime, denylist)
+		if err != nil {
+			if denylist != nil {
+				denylist.gcStop()
+			}
+			return nil, err
+		}
+
+		return jwt, nil
+	}
+
+	return nil, fmt.Errorf("%w: %s", errSessionType, p.cfg.GetString("sessiontype"))
+}
+
+// send session key to client
+func (srvc *pgmusql) setAuthkey(rw http.ResponseWriter, authkey string, expire time.Time) {
+	if srvc.cookieSession {
+		var cookie http.Cookie
+		cookie.Name = srvcAuthCookieName
+		cookie.Value = authkey
+		cookie.HttpOnly = true
+		if srvc.useTLS {
+			cookie.Secure = true
+		}
+		cookie.Expires = expire
+		cookie.SameSite = srvc.sameSite
+
+		http.SetCookie(rw, &cookie)
+
+		if srvc.csrf != nil {
+			srvc.csrf.set(rw, authkey, cookie)
+		}
+	} else {
+		rw.Header().Set("Authorization", authkey)
+	}
+}
+
+// check request and prepare form or json data
+var errContentType = fmt.Errorf("Only %s or %s content type allowed", srvcExpectedContentType, srvcJSONContentType)
+
+func (srvc *pgmusql) checkRequest(rw http.ResponseWriter, req *http.Request) (queryParams, int, error) {
 	// check content type
-	if req.Header.Get("Content-Type") != srvcExpectedContentType {
-		return http.StatusBadRequest, errContentType
+	contentType, _, err := mime.ParseMediaType(req.Header.Get("Content-Type"))
+	if err != nil {
+		return nil, http.StatusBadRequest, errContentType
 	}
 
+	switch contentType {
 	// parse form
-	if err := req.ParseForm(); err != nil {
-		return http.StatusInternalServerError, err
+	case srvcExpectedContentType:
+		if err := req.ParseForm(); err != nil {
+			return nil, http.StatusBadRequest, &requestError{err}
+		}
+
+		params := queryParamsFromForm(req.Form)
+		if err := params.checkReserved(); err != nil {
+			return nil, http.StatusBadRequest, err
+		}
+
+		return params, 200, nil
+	// parse json object
+	case srvcJSONContentType:
+		params, err := queryParamsFromJSON(http.MaxBytesReader(rw, req.Body, srvcMaxBodySize), req.URL.Query())
+		if err == nil {
+			err = params.checkReserved()
+		}
+		if err != nil {
+			return nil, http.StatusBadRequest, err
+		}
+
+		return params, 200, nil
 	}
 
-	return 200, nil
+	return nil, http.StatusBadRequest, errContentType
 }
 
 // write success result
-func (srvc *pgmusql) sqlWriteSuccess(rw http.ResponseWriter, result []byte) {
-	rw.Header().Set("Content-Type", srvcOutputContentType)
-	if srvc.keepalive {
+func (srvc *pgmusql) sqlWriteSuccess(rw http.ResponseWriter, format resultFormat, result []byte) {
+	rw.Header().Set("Content-Type", format.contentType())
+	if srvc.opts().keepalive {
 		rw.Header().Set("Connection", "Keep-Alive")
 	}
 
 	if _, err := rw.Write(result); err != nil {
-		http.Error(rw, err.Error(), http.StatusInternalServerError)
+		log.Println(err)
 		return
 	}
 }
 
+// check session and access rules of query, session data is added to params.
+// Returns client of validated API key, certificate or session, empty if there is no one.
+func (srvc *pgmusql) authorize(rw http.ResponseWriter, req *http.Request, queryname string, access queryAccess, params queryParams) (string, error) {
+	if access.mode == accessDefault {
+		if access.mode = accessPublic; srvc.loginRequired {
+			access.mode = accessAuthenticated
+		}
+	}
+
+	// API key of machine client is used instead of session
+	if srvc.apiKeys != nil {
+		if key := req.Header.Get(srvc.apiKeyHeader); key != "" {
+			return srvc.authorizeAPIKey(req, key, queryname, access, params)
+		}
+	}
+
+	// verified client certificate is used instead of session
+	if req.TLS != nil && len(req.TLS.VerifiedChains) > 0 {
+		data := certIdentity(req.TLS.VerifiedChains[0][0], srvc.clientIdentity)
+		if access.mode == accessRules && !access.allowed(data, srvc.accessRoleColumn) {
+			return "", errAccessDenied
+		}
+
+		params.addSession(data)
+		return "cert:" + req.TLS.VerifiedChains[0][0].Subject.String(), nil
+	}
+
+	// there are no sessions without login
+	if !srvc.loginRequired {
+		if access.mode != accessPublic {
+			return "", errAccessDenied
+		}
+		return "", nil
+	}
+
+	authkey, err := srvc.getAuthkey(req)
+	if err == nil {
+		var sess session
+		if sess, err = srvc.sessions.check(req.Context(), authkey); err == nil {
+			params.addSession(sess.data)
+
+			// extended session needs new cookie expiration
+			if srvc.sessions.slidingExpiration() {
+				srvc.setAuthkey(rw, authkey, sess.expire)
+			}
+
+			if access.mode == accessRules && !access.allowed(sess.data, srvc.accessRoleColumn) {
+				return "", errAccessDenied
+			}
+
+			// session key is hashed, so limiter state doesn't disclose it
+			hash := sha256.Sum256([]byte(authkey))
+			return "session:" + hex.EncodeToString(hash[:8]), nil
+		}
+	}
+
+	// public query is called without session data if session is missing or invalid
+	if access.mode == accessPublic {
+		return "", nil
+	}
+
+	return "", err
+}
+
+// check API key, its scopes and access rules of query, key data is added to params
+func (srvc *pgmusql) authorizeAPIKey(req *http.Request, key string, queryname string, access queryAccess, params queryParams) (string, error) {
+	apiKey, err := srvc.apiKeys.get(req.Context(), apiKeyHash(key))
+	if err != nil {
+		return "", err
+	}
+
+	if apiKey == nil || apiKey.expired() {
+		log.Printf("Invalid or expired API key from %s\n", clientIP(req))
+		return "", errAPIKeyInvalid
+	}
+
+	if !apiKey.allowed(queryname) || (access.mode == accessRules && !access.allowed(apiKey.Data, srvc.accessRoleColumn)) {
+		log.Printf("API key %s: access to %s denied\n", apiKey.Label, queryname)
+		return "", errAccessDenied
+	}
+
+	log.Printf("API key %s: %s\n", apiKey.Label, queryname)
+	params.addSession(apiKey.Data)
+	return "apikey:" + apiKeyHash(key)[:16], nil
+}
+
 // execution query handler
 func (srvc *pgmusql) sqlHandler(rw http.ResponseWriter, req *http.Request) {
 	// check request
-	if code, err := srvc.checkRequest(req); err != nil {
-		http.Error(rw, err.Error(), code)
+	params, code, err := srvc.checkRequest(rw, req)
+	if err != nil {
+		srvc.writeError(rw, code, err)
 		return
 	}
 
 	queryname := req.URL.Path[len(srvcSQLURL)-1:]
 
-	// check session and login query
-	var err error
-	if srvc.loginRequired {
-		if queryname == srvc.loginQuery || queryname == srvc.logoutQuery {
-			http.Error(rw, "Calling this query directly is prohibited.", http.StatusForbidden)
-			return
-		}
+	// check login query
+	if srvc.loginRequired && (queryname == srvc.loginQuery || queryname == srvc.logoutQuery) {
+		srvc.writeError(rw, 0, errQueryProhibited)
+		return
+	}
 
-		var authkey string
-		if authkey, err = srvc.getAuthkey(req); err != nil {
-			http.Error(rw, err.Error(), http.StatusUnauthorized)
+	// query is found once, so the checked version runs even if it is reloaded meanwhile.
+	// Unknown query has default access, so its absence is not disclosed to unauthorized clients
+	query, found := srvc.getQuery(queryname)
+	var access queryAccess
+	if found {
+		access = query.access
+	}
+	client, err := srvc.authorize(rw, req, queryname, access, params)
+	if err != nil {
+		srvc.writeError(rw, 0, err)
+		return
+	}
+
+	// run query, result format is chosen by Accept header or query format directive
+	var res []byte
+	format := formatJSON
+	stream := false
+	if query, err = queryUsable(query, found); err == nil {
+		var release func()
+		if release, err = srvc.limiter.acquire(req, client, query); err != nil {
+			if e, ok := err.(*rateLimitError); ok {
+				rw.Header().Set("Retry-After", strconv.Itoa(int(e.retry.Seconds()+1)))
+			}
+			srvc.writeError(rw, 0, err)
 			return
 		}
+		defer release()
 
-		if !srvc.sessions.check(authkey) {
-			http.Error(rw, "Session key is invalid", http.StatusUnauthorized)
-			return
+		format = negotiateFormat(req.Header.Get("Accept"), query.format)
+
+		if stream = srvc.opts().streamResults; query.stream != nil {
+			stream = *query.stream
 		}
-	}
 
-	// run query
-	var res []byte
-	if res, _, err = srvc.runQuery(req.Context(), queryname, req.Form, 0); err != nil {
-		switch err {
-		case errQueryNotFound:
-			http.NotFound(rw, req)
-		case errQueryTimeout:
-			http.Error(rw, "Query timeout", http.StatusGatewayTimeout)
-		default:
-			http.Error(rw, err.Error(), http.StatusInternalServerError)
+		if stream {
+			err = srvc.streamQuery(req.Context(), rw, query, params, format)
+		} else {
+			res, _, err = srvc.execQuery(req.Context(), query, params, format, 0)
 		}
+	}
 
+	if err != nil {
+		srvc.writeError(rw, 0, err)
 		return
 	}
 
-	// Success result
-	srvc.sqlWriteSuccess(rw, res)
+	// Success result, stream is already written
+	if stream {
+		return
+	}
+	srvc.sqlWriteSuccess(rw, format, res)
 }
 
 // login handler
@@ -347,83 +725,160 @@ var errLoginNoData = errors.New("No data")
 
 func (srvc *pgmusql) loginHandler(rw http.ResponseWriter, req *http.Request) {
 	// check request
-	if code, err := srvc.checkRequest(req); err != nil {
-		http.Error(rw, err.Error(), code)
+	params, code, err := srvc.checkRequest(rw, req)
+	if err != nil {
+		srvc.writeError(rw, code, err)
 		return
 	}
 
+	// brute-force protection, attempt is reserved before login query
+	var reserved []loginReserve
+	if srvc.loginGuard != nil {
+		var wait time.Duration
+		if reserved, wait = srvc.loginGuard.reserve(srvc.loginGuard.keys(req, params)); wait > 0 {
+			rw.Header().Set("Retry-After", strconv.Itoa(int(wait.Seconds()+1)))
+			srvc.writeError(rw, 0, errLoginLocked)
+			return
+		}
+	}
+
 	// run query
 	var res []byte
 	var total int
-	var err error
-	if res, total, err = srvc.runQuery(req.Context(), srvc.loginQuery, req.Form, 0); err != nil || total == 0 {
+	if res, total, err = srvc.runQuery(req.Context(), srvc.loginQuery, params, 0); err != nil || total == 0 {
 		if err == nil {
 			err = errLoginNoData
 		}
-		http.Error(rw, err.Error(), http.StatusForbidden)
+
+		if srvc.loginGuard != nil {
+			if err == errLoginNoData || srvc.isAuthError(err) {
+				srvc.loginGuard.fail(reserved)
+			} else {
+				srvc.loginGuard.refund(reserved)
+			}
+		}
+		srvc.writeError(rw, 0, err)
+		return
+	}
+
+	if srvc.loginGuard != nil {
+		srvc.loginGuard.success(reserved)
+	}
+
+	// save the first result row with session, it's columns are passed to queries as reserved params
+	data, err := queryParamsFromJSONRow(res)
+	if err != nil {
+		srvc.writeError(rw, 0, err)
 		return
 	}
 
 	// create session and return data
 	var session string
 	var expire time.Time
-	if session, expire, err = srvc.sessions.new(); err != nil {
-		http.Error(rw, err.Error(), http.StatusForbidden)
+	if session, expire, err = srvc.sessions.new(req.Context(), data); err != nil {
+		srvc.writeError(rw, http.StatusForbidden, err)
 		return
 	}
 
-	if srvc.cookieSession {
-		var cookie http.Cookie
-		cookie.Name = srvcAuthCookieName
-		cookie.Value = session
-		cookie.HttpOnly = true
-		if srvc.useTLS {
-			cookie.Secure = true
-		}
-		cookie.Expires = expire
-
-		http.SetCookie(rw, &cookie)
-	} else {
-		rw.Header().Set("Authorization", session)
-	}
+	srvc.setAuthkey(rw, session, expire)
 
 	// Success result
-	srvc.sqlWriteSuccess(rw, res)
+	srvc.sqlWriteSuccess(rw, formatJSON, res)
 }
 
 // logout handler
 func (srvc *pgmusql) logoutHandler(rw http.ResponseWriter, req *http.Request) {
 	// check request
-	if code, err := srvc.checkRequest(req); err != nil {
-		http.Error(rw, err.Error(), code)
+	params, code, err := srvc.checkRequest(rw, req)
+	if err != nil {
+		srvc.writeError(rw, code, err)
 		return
 	}
 
 	// get session key
 	var authkey string
-	var err error
 	if authkey, err = srvc.getAuthkey(req); err != nil {
-		http.Error(rw, err.Error(), http.StatusUnauthorized)
+		srvc.writeError(rw, 0, err)
 		return
 	}
 
 	var res []byte
 	if srvc.logoutQuery != "" {
+		if sess, err := srvc.sessions.check(req.Context(), authkey); err == nil {
+			params.addSession(sess.data)
+		}
+
 		// run query
 
 		var total int
-		if res, total, err = srvc.runQuery(req.Context(), srvc.logoutQuery, req.Form, 0); err != nil || total == 0 {
+		if res, total, err = srvc.runQuery(req.Context(), srvc.logoutQuery, params, 0); err != nil || total == 0 {
 			if err == nil {
 				err = errLoginNoData
 			}
-			http.Error(rw, err.Error(), http.StatusForbidden)
+			srvc.writeError(rw, 0, err)
 			return
 		}
 	}
 
 	// delete session key
-	srvc.sessions.logout(authkey)
+	if err = srvc.sessions.logout(req.Context(), authkey); err != nil {
+		srvc.writeError(rw, 0, err)
+		return
+	}
+
+	// Success result
+	srvc.sqlWriteSuccess(rw, formatJSON, res)
+}
+
+// refresh handler, replaces session key by new one with renewed expiration
+func (srvc *pgmusql) refreshHandler(rw http.ResponseWriter, req *http.Request) {
+	// check request, refresh has no params
+	if _, code, err := srvc.checkRequest(rw, req); err != nil {
+		srvc.writeError(rw, code, err)
+		return
+	}
+
+	// get session key
+	authkey, err := srvc.getAuthkey(req)
+	if err != nil {
+		srvc.writeError(rw, 0, err)
+		return
+	}
+
+	session, sess, err := srvc.sessions.refresh(req.Context(), authkey)
+	if err != nil {
+		srvc.writeError(rw, 0, err)
+		return
+	}
+
+	// return session data as login does
+	res, err := json.Marshal([]queryParams{sess.data})
+	if err != nil {
+		srvc.writeError(rw, 0, err)
+		return
+	}
+
+	srvc.setAuthkey(rw, session, sess.expire)
 
 	// Success result
-	srvc.sqlWriteSuccess(rw, res)
+	srvc.sqlWriteSuccess(rw, formatJSON, res)
+}
+
+// limiter state handler
+func (srvc *pgmusql) limitsHandler(rw http.ResponseWriter, req *http.Request) {
+	if _, err := srvc.authorize(rw, req, srvcLimitsURL, srvc.adminAccess, queryParams{}); err != nil {
+		srvc.writeError(rw, 0, err)
+		return
+	}
+
+	res, err := json.Marshal(struct {
+		Global string       `json:"global"`
+		Limits []limitState `json:"limits"`
+	}{srvc.limiter.getConfig().String(), srvc.limiter.state()})
+	if err != nil {
+		srvc.writeError(rw, 0, err)
+		return
+	}
+
+	srvc.sqlWriteSuccess(rw, formatJSON, res)
 }
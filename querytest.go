@@ -91,7 +91,7 @@ func (srvc *pgmusql) queryTestWorker(ctx context.Context, task <-chan *query, re
 	defer log.Printf("Test worker %d stop\n", id)
 
 	for t := range task {
-		log.Printf("Test worker (%d): in que %d run query %s\n", id, len(task), t.name)
+		log.Printf("Test worker (%d): in que %d run query %s on database %s\n", id, len(task), t.name, t.databaseName())
 		err := srvc.queryTestScenario(ctx, t, ignorerrors)
 		select {
 		case <-ctx.Done():
@@ -113,7 +113,7 @@ func (srvc *pgmusql) queryTestScenario(ctx context.Context, query *query, ignore
 
 	// error handling
 	handleErr := func(perr error) error {
-		err := errors.New("Autotest error: " + perr.Error())
+		err := errors.New("Autotest error: " + srvc.db.muteError(perr).Error())
 		if ignorerrors {
 			query.err = err
 			return nil
@@ -123,8 +123,8 @@ func (srvc *pgmusql) queryTestScenario(ctx context.Context, query *query, ignore
 
 	testStartTime := time.Now()
 
-	params := query.testparams.toURLValues()
-	result, total, err := srvc.runQuery(ctx, query.name, params, testMaxRows)
+	params := queryParamsFromForm(query.testparams.toURLValues())
+	result, total, err := srvc.execQuery(ctx, query, params, formatJSON, testMaxRows)
 
 	if err != nil {
 		return handleErr(err)
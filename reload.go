@@ -0,0 +1,174 @@
+package main
+
+import (
+	"crypto/tls"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+// service options that can be changed at runtime
+type srvcOptions struct {
+	timeout       time.Duration
+	keepalive     bool
+	streamResults bool
+	sqlStates     *sqlStateMapper
+}
+
+func srvcOptionsFromCfg(cfg *viper.Viper) srvcOptions {
+	return srvcOptions{
+		timeout:       cfg.GetDuration("querytimeout"),
+		keepalive:     cfg.GetBool("keepalive"),
+		streamResults: cfg.GetBool("streamresults"),
+		sqlStates:     sqlStateMapperNew(cfg.GetStringMap("sqlstatestatus"), cfg.GetString("sqlstatehttpprefix")),
+	}
+}
+
+func (srvc *pgmusql) opts() srvcOptions {
+	return srvc.options.Load().(srvcOptions)
+}
+
+func dbOptionsFromCfg(cfg *viper.Viper) dbOptions {
+	return dbOptions{
+		filterOutParams:  cfg.GetBool("filteroutparams"),
+		filterInParams:   cfg.GetBool("filterinparams"),
+		muteDbErr:        cfg.GetBool("mutedberrors"),
+		statementTimeout: cfg.GetBool("statementtimeout"),
+		txRetries:        cfg.GetInt("txretries"),
+		txRetryDelay:     cfg.GetDuration("txretrydelay"),
+	}
+}
+
+func limitConfigFromCfg(cfg *viper.Viper) (limitConfig, error) {
+	limits := limitConfig{
+		rate:       cfg.GetFloat64("ratelimit"),
+		burst:      cfg.GetInt("rateburst"),
+		concurrent: cfg.GetInt("maxconcurrent"),
+	}
+	err := limits.key.parse(strings.ToLower(cfg.GetString("limitkey")))
+	return limits, err
+}
+
+// settings applied on reload, table settings are matched by table name
+var runtimeSettings = []string{
+	"querytimeout", "keepalive", "streamresults", "sqlstatestatus", "sqlstatehttpprefix",
+	"filteroutparams", "filterinparams", "mutedberrors", "statementtimeout", "txretries", "txretrydelay",
+	"ratelimit", "rateburst", "maxconcurrent", "limitkey",
+	"certfile", "keyfile",
+}
+
+func isRuntimeSetting(key string) bool {
+	for _, setting := range runtimeSettings {
+		if key == setting || strings.HasPrefix(key, setting+".") {
+			return true
+		}
+	}
+	return false
+}
+
+// reload config file and certificate, apply runtime settings and report settings that need restart
+func (srvc *pgmusql) reload() {
+	log.Println("Reload config")
+	cfg, err := cfgNew(srvc.cfgFile)
+	if err != nil {
+		log.Println("Config reload error:", err)
+		return
+	}
+
+	// check new settings before applying any of them
+	limits, err := limitConfigFromCfg(cfg)
+	if err != nil {
+		log.Println("Config reload error:", err)
+		return
+	}
+
+	if srvc.certs != nil {
+		if err := srvc.certs.load(cfg.GetString("certfile"), cfg.GetString("keyfile")); err != nil {
+			log.Println("Certificate reload error:", err)
+			return
+		}
+		log.Println("Certificate reloaded")
+	}
+
+	srvc.options.Store(srvcOptionsFromCfg(cfg))
+	dbOpts := dbOptionsFromCfg(cfg)
+	for _, db := range srvc.dbs {
+		db.setOpts(dbOpts)
+	}
+	srvc.limiter.setConfig(limits)
+
+	// diff of settings
+	settings := cfgFlatten(cfg)
+	keys := make([]string, 0, len(settings))
+	for key := range settings {
+		keys = append(keys, key)
+	}
+	for key := range srvc.applied {
+		if _, ok := settings[key]; !ok {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	changes := 0
+	for _, key := range keys {
+		old, val := srvc.applied[key], settings[key]
+		if old == val {
+			continue
+		}
+		changes++
+
+		// other settings can hold credentials (database urls, secrets), only their names are logged
+		if !isRuntimeSetting(key) {
+			log.Printf("Config %s changed, restart is required to apply it\n", key)
+			continue
+		}
+
+		log.Printf("Config %s changed: %q -> %q\n", key, old, val)
+		if val == "" {
+			delete(srvc.applied, key)
+		} else {
+			srvc.applied[key] = val
+		}
+	}
+
+	log.Printf("Config reloaded, %d settings changed\n", changes)
+}
+
+// server certificate, replaced on reload without restart
+type certReloader struct {
+	cert *tls.Certificate
+	lock *sync.RWMutex
+}
+
+func certReloaderNew(certFile string, keyFile string) (*certReloader, error) {
+	r := certReloader{lock: new(sync.RWMutex)}
+	if err := r.load(certFile, keyFile); err != nil {
+		return nil, err
+	}
+
+	return &r, nil
+}
+
+func (r *certReloader) load(certFile string, keyFile string) error {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return err
+	}
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.cert = &cert
+	return nil
+}
+
+// tls.Config GetCertificate callback
+func (r *certReloader) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	return r.cert, nil
+}
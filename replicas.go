@@ -0,0 +1,185 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/jackc/pgconn"
+	"github.com/jackc/pgx/v4"
+)
+
+// replay lag of standby, zero if all received wal is replayed or server is not a standby
+const replicaLagSQL = `select case when pg_last_wal_receive_lsn() = pg_last_wal_replay_lsn() then 0
+	else coalesce(extract(epoch from now() - pg_last_xact_replay_timestamp()), 0) end`
+
+var errReplicaCheckPeriod = errors.New("Replica check period must be positive")
+
+// read replica of database
+type replica struct {
+	name    string // database name and replica number for logs
+	db      *database
+	healthy int32 // 1 if replica is in rotation, 0 if it is not, -1 before the first check, atomic
+}
+
+func (r *replica) isHealthy() bool {
+	return atomic.LoadInt32(&r.healthy) == 1
+}
+
+// take replica in or out of rotation, state change is logged
+func (r *replica) setHealthy(healthy bool, reason string) {
+	var val int32
+	if healthy {
+		val = 1
+	}
+
+	if atomic.SwapInt32(&r.healthy, val) == val {
+		return
+	}
+
+	if healthy {
+		log.Printf("Replica %s is in rotation\n", r.name)
+	} else {
+		log.Printf("Replica %s is out of rotation: %s\n", r.name, reason)
+	}
+}
+
+// read replicas of database with round robin balancing.
+// Replicas are out of rotation until the first health check passes.
+type replicaSet struct {
+	replicas        []*replica
+	next            uint32 // round robin counter, atomic
+	maxLag          time.Duration
+	detectSelect    bool // plain select queries are read-only
+	contextCancelFn context.CancelFunc
+	wg              sync.WaitGroup
+}
+
+func replicaSetNew(ctx context.Context, name string, urls []string, poolOpts dbPoolOptions, opts dbOptions, sessionRole string, sessionSettings map[string]string,
+	maxLag time.Duration, checkPeriod time.Duration, detectSelect bool) (*replicaSet, error) {
+	if checkPeriod <= 0 {
+		return nil, errReplicaCheckPeriod
+	}
+
+	s := replicaSet{maxLag: maxLag, detectSelect: detectSelect}
+
+	for i, url := range urls {
+		// replica can be unreachable on start, it joins rotation when health check passes
+		db, err := dbNew(ctx, url, true, poolOpts, opts, sessionRole, sessionSettings)
+		if err != nil {
+			s.close()
+			return nil, fmt.Errorf("replica %d: %w", i+1, err)
+		}
+		s.replicas = append(s.replicas, &replica{name: fmt.Sprintf("%s/%d", name, i+1), db: db, healthy: -1})
+	}
+
+	var checkContext context.Context
+	checkContext, s.contextCancelFn = context.WithCancel(ctx)
+
+	// run health checker
+	s.wg.Add(1)
+	go s.healthCheck(checkContext, checkPeriod)
+
+	return &s, nil
+}
+
+// replica health checker
+func (s *replicaSet) healthCheck(ctx context.Context, period time.Duration) {
+	log.Println("Replica health checker start")
+	defer s.wg.Done()
+	defer log.Println("Replica health checker stop")
+
+	timer := time.NewTicker(period)
+	defer timer.Stop()
+	for {
+		for _, r := range s.replicas {
+			s.check(ctx, r, period)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-timer.C:
+		}
+	}
+}
+
+// check replica connection and replay lag
+func (s *replicaSet) check(ctx context.Context, r *replica, timeout time.Duration) {
+	checkCtx, cancelFn := context.WithTimeout(ctx, timeout)
+	defer cancelFn()
+
+	var lag float64
+	if err := r.db.pool.QueryRow(checkCtx, replicaLagSQL).Scan(&lag); err != nil {
+		if ctx.Err() == nil {
+			r.setHealthy(false, err.Error())
+		}
+		return
+	}
+
+	if lagTime := time.Duration(lag * float64(time.Second)); s.maxLag > 0 && lagTime > s.maxLag {
+		r.setHealthy(false, "replay lag "+lagTime.Round(time.Millisecond).String())
+		return
+	}
+
+	r.setHealthy(true, "")
+}
+
+// next healthy replica, nil if there is no one
+func (s *replicaSet) pick() *replica {
+	n := uint32(len(s.replicas))
+	start := atomic.AddUint32(&s.next, 1)
+	for i := uint32(0); i < n; i++ {
+		if r := s.replicas[(start+i)%n]; r.isHealthy() {
+			return r
+		}
+	}
+	return nil
+}
+
+// query can run on replica: read-only by directive or detected plain select.
+// Standby servers don't support serializable transactions.
+func (s *replicaSet) routable(q query) bool {
+	if q.txOptions.IsoLevel == pgx.Serializable {
+		return false
+	}
+
+	switch q.txOptions.AccessMode {
+	case pgx.ReadOnly:
+		return true
+	case pgx.ReadWrite:
+		return false
+	}
+
+	return s.detectSelect && q.plainSelect
+}
+
+// stop health checker and close replica connections
+func (s *replicaSet) close() {
+	if s.contextCancelFn != nil {
+		s.contextCancelFn()
+		s.wg.Wait()
+	}
+
+	for _, r := range s.replicas {
+		r.db.close()
+	}
+}
+
+// replica connection failed and query can be run on primary
+func replicaIsDown(err error) bool {
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) {
+		// connection_exception and operator_intervention (admin shutdown, cannot connect now)
+		return strings.HasPrefix(pgErr.Code, "08") || strings.HasPrefix(pgErr.Code, "57P")
+	}
+
+	var netErr net.Error
+	return errors.As(err, &netErr) || pgconn.SafeToRetry(err)
+}
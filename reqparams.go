@@ -0,0 +1,199 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"strings"
+)
+
+// reserved params prefix, session params are passed to queries as :_session_<column>
+const sessionParamPrefix = "_session_"
+
+// Query input params.
+// Value is []string for form values or decoded json value (string, json.Number, bool, nil, []interface{}, map[string]interface{})
+type queryParams map[string]interface{}
+
+// create params from form values
+func queryParamsFromForm(form url.Values) queryParams {
+	res := make(queryParams, len(form))
+	for key, val := range form {
+		res[key] = val
+	}
+	return res
+}
+
+// create params from json object
+var errJSONNotObject = errors.New("Request body must be a JSON object")
+var errJSONTrailingData = errors.New("Request body must contain a single JSON object")
+
+// malformed request body
+type requestError struct {
+	err error
+}
+
+func (e *requestError) Error() string {
+	return "Invalid request body: " + e.err.Error()
+}
+
+func (e *requestError) Unwrap() error {
+	return e.err
+}
+
+func queryParamsFromJSON(body io.Reader, query url.Values) (queryParams, error) {
+	res := queryParamsFromForm(query)
+
+	var obj map[string]interface{}
+	dec := json.NewDecoder(body)
+	dec.UseNumber()
+	if err := dec.Decode(&obj); err != nil {
+		if err == io.EOF {
+			return res, nil
+		}
+		if _, ok := err.(*json.UnmarshalTypeError); ok {
+			return nil, errJSONNotObject
+		}
+		return nil, &requestError{err}
+	}
+
+	// nothing but whitespace after the object
+	if _, err := dec.Token(); err != io.EOF {
+		return nil, errJSONTrailingData
+	}
+
+	for key, val := range obj {
+		res[key] = val
+	}
+
+	return res, nil
+}
+
+// create params from the first row of json array of objects
+func queryParamsFromJSONRow(res []byte) (queryParams, error) {
+	var rows []map[string]interface{}
+	dec := json.NewDecoder(bytes.NewReader(res))
+	dec.UseNumber()
+	if err := dec.Decode(&rows); err != nil {
+		return nil, err
+	}
+
+	if len(rows) == 0 {
+		return queryParams{}, nil
+	}
+	return rows[0], nil
+}
+
+// client can't pass reserved params
+var errParamReserved = errors.New("parameter name is reserved")
+
+func (params queryParams) checkReserved() error {
+	for key := range params {
+		if strings.HasPrefix(strings.ToLower(key), sessionParamPrefix) {
+			return &paramError{key, errParamReserved}
+		}
+	}
+	return nil
+}
+
+// add session data as reserved params
+func (params queryParams) addSession(data queryParams) {
+	for key, val := range data {
+		params[sessionParamPrefix+strings.ToLower(key)] = val
+	}
+}
+
+// params has session data
+func (params queryParams) hasSession() bool {
+	for key := range params {
+		if strings.HasPrefix(key, sessionParamPrefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// param value as string, the first value of form param
+func (params queryParams) stringValue(name string) (string, bool) {
+	val, ok := params[name]
+	if !ok || val == nil {
+		return "", false
+	}
+
+	if form, ok := val.([]string); ok {
+		return form[0], true
+	}
+
+	str, err := jsonValueString(val)
+	return str, err == nil
+}
+
+// value is sent but empty
+func paramIsEmpty(val interface{}) bool {
+	switch v := val.(type) {
+	case []string:
+		return v[0] == ""
+	case string:
+		return v == ""
+	}
+	return false
+}
+
+// json value to string representation, nested values are json text
+func jsonValueString(val interface{}) (string, error) {
+	switch v := val.(type) {
+	case string:
+		return v, nil
+	case json.Number:
+		return v.String(), nil
+	case bool:
+		return fmt.Sprint(v), nil
+	}
+
+	return jsonValue(val)
+}
+
+// json value to list of strings, used for conversion to declared param type
+var errParamArray = errors.New("array is not allowed")
+var errParamObject = errors.New("object is not allowed")
+
+func jsonValueStrings(val interface{}, ptype *paramType) ([]string, error) {
+	// json params get json text of any value
+	if ptype.isJSON() {
+		str, err := jsonValue(val)
+		return []string{str}, err
+	}
+
+	switch v := val.(type) {
+	case []interface{}:
+		if !ptype.array {
+			return nil, errParamArray
+		}
+
+		res := make([]string, 0, len(v))
+		for _, elem := range v {
+			str, err := jsonValueString(elem)
+			if err != nil {
+				return nil, err
+			}
+			res = append(res, str)
+		}
+		return res, nil
+	case map[string]interface{}:
+		return nil, errParamObject
+	}
+
+	str, err := jsonValueString(val)
+	return []string{str}, err
+}
+
+// json text of value
+func jsonValue(val interface{}) (string, error) {
+	jsn, err := json.Marshal(val)
+	if err != nil {
+		return "", err
+	}
+	return string(jsn), nil
+}
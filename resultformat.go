@@ -0,0 +1,320 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type resultFormat int
+
+const (
+	formatJSON    resultFormat = iota // json array of objects
+	formatCompact                     // json object with columns and rows arrays
+	formatNDJSON                      // newline delimited json objects
+	formatCSV                         // csv with header row
+)
+
+func (f resultFormat) String() string {
+	return [...]string{"json", "compact", "ndjson", "csv"}[f]
+}
+
+func (f *resultFormat) parse(str string) error {
+	switch str {
+	case formatJSON.String():
+		*f = formatJSON
+	case formatCompact.String():
+		*f = formatCompact
+	case formatNDJSON.String():
+		*f = formatNDJSON
+	case formatCSV.String():
+		*f = formatCSV
+	default:
+		return errors.New("Invalid format string: " + str)
+	}
+	return nil
+}
+
+// media types of formats
+var formatMediaTypes = map[string]resultFormat{
+	"application/json":                     formatJSON,
+	"application/vnd.pgmusql.compact+json": formatCompact,
+	"application/x-ndjson":                 formatNDJSON,
+	"application/ndjson":                   formatNDJSON,
+	"text/csv":                             formatCSV,
+}
+
+func (f resultFormat) contentType() string {
+	return [...]string{
+		srvcOutputContentType,
+		"application/vnd.pgmusql.compact+json;charset=UTF-8",
+		"application/x-ndjson;charset=UTF-8",
+		"text/csv;charset=UTF-8",
+	}[f]
+}
+
+// choose format by Accept header, supported media type with the highest quality wins,
+// on equal quality the first one. Any type "*/*" means query default format and
+// has lower precedence than media types of equal quality.
+// If there is no supported media type, then query default format is used.
+func negotiateFormat(accept string, def resultFormat) resultFormat {
+	type acceptItem struct {
+		format resultFormat
+		q      float64
+		any    bool
+	}
+
+	var items []acceptItem
+	for _, item := range strings.Split(accept, ",") {
+		mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(item))
+		if err != nil {
+			continue
+		}
+
+		q := 1.0
+		if str, ok := params["q"]; ok {
+			if q, err = strconv.ParseFloat(str, 64); err != nil {
+				continue
+			}
+		}
+		if q <= 0 {
+			continue
+		}
+
+		if mediaType == "*/*" {
+			items = append(items, acceptItem{def, q, true})
+		} else if format, ok := formatMediaTypes[mediaType]; ok {
+			items = append(items, acceptItem{format, q, false})
+		}
+	}
+
+	sort.SliceStable(items, func(i, j int) bool {
+		if items[i].q != items[j].q {
+			return items[i].q > items[j].q
+		}
+		return !items[i].any && items[j].any
+	})
+
+	if len(items) > 0 {
+		return items[0].format
+	}
+	return def
+}
+
+// rows encoder
+type rowsEncoder interface {
+	begin(columns []string) error
+	row(values []interface{}) error
+	end() error
+	flush() error // write buffered data
+}
+
+func (f resultFormat) encoder(w io.Writer) rowsEncoder {
+	switch f {
+	case formatCompact:
+		return &compactEncoder{w: w}
+	case formatNDJSON:
+		return &ndjsonEncoder{w: w}
+	case formatCSV:
+		return &csvEncoder{w: csv.NewWriter(w)}
+	}
+
+	return &jsonEncoder{w: w}
+}
+
+// write json object with ordered keys
+func writeJSONObject(w io.Writer, columns []string, values []interface{}) error {
+	buf := []byte{'{'}
+	for i, column := range columns {
+		if i > 0 {
+			buf = append(buf, ',')
+		}
+
+		key, err := json.Marshal(column)
+		if err != nil {
+			return err
+		}
+		val, err := json.Marshal(values[i])
+		if err != nil {
+			return err
+		}
+
+		buf = append(buf, key...)
+		buf = append(buf, ':')
+		buf = append(buf, val...)
+	}
+	buf = append(buf, '}')
+
+	_, err := w.Write(buf)
+	return err
+}
+
+// json array of objects
+type jsonEncoder struct {
+	w       io.Writer
+	columns []string
+	rows    int
+}
+
+func (e *jsonEncoder) begin(columns []string) error {
+	e.columns = columns
+	_, err := io.WriteString(e.w, "[")
+	return err
+}
+
+func (e *jsonEncoder) row(values []interface{}) error {
+	if e.rows > 0 {
+		if _, err := io.WriteString(e.w, ","); err != nil {
+			return err
+		}
+	}
+	e.rows++
+
+	return writeJSONObject(e.w, e.columns, values)
+}
+
+func (e *jsonEncoder) end() error {
+	_, err := io.WriteString(e.w, "]")
+	return err
+}
+
+func (e *jsonEncoder) flush() error {
+	return nil
+}
+
+// json object {"columns": [...], "rows": [[...], ...]}
+type compactEncoder struct {
+	w    io.Writer
+	rows int
+}
+
+func (e *compactEncoder) begin(columns []string) error {
+	jsn, err := json.Marshal(columns)
+	if err != nil {
+		return err
+	}
+
+	_, err = fmt.Fprintf(e.w, `{"columns":%s,"rows":[`, jsn)
+	return err
+}
+
+func (e *compactEncoder) row(values []interface{}) error {
+	jsn, err := json.Marshal(values)
+	if err != nil {
+		return err
+	}
+
+	if e.rows > 0 {
+		if _, err := io.WriteString(e.w, ","); err != nil {
+			return err
+		}
+	}
+	e.rows++
+
+	_, err = e.w.Write(jsn)
+	return err
+}
+
+func (e *compactEncoder) end() error {
+	_, err := io.WriteString(e.w, "]}")
+	return err
+}
+
+func (e *compactEncoder) flush() error {
+	return nil
+}
+
+// newline delimited json objects
+type ndjsonEncoder struct {
+	w       io.Writer
+	columns []string
+}
+
+func (e *ndjsonEncoder) begin(columns []string) error {
+	e.columns = columns
+	return nil
+}
+
+func (e *ndjsonEncoder) row(values []interface{}) error {
+	if err := writeJSONObject(e.w, e.columns, values); err != nil {
+		return err
+	}
+
+	_, err := io.WriteString(e.w, "\n")
+	return err
+}
+
+func (e *ndjsonEncoder) end() error {
+	return nil
+}
+
+func (e *ndjsonEncoder) flush() error {
+	return nil
+}
+
+// csv with header row
+type csvEncoder struct {
+	w *csv.Writer
+}
+
+func (e *csvEncoder) begin(columns []string) error {
+	return e.w.Write(columns)
+}
+
+func (e *csvEncoder) row(values []interface{}) error {
+	record := make([]string, len(values))
+	for i, val := range values {
+		str, err := csvValue(val)
+		if err != nil {
+			return err
+		}
+		record[i] = str
+	}
+
+	return e.w.Write(record)
+}
+
+func (e *csvEncoder) end() error {
+	return e.flush()
+}
+
+func (e *csvEncoder) flush() error {
+	e.w.Flush()
+	return e.w.Error()
+}
+
+// csv field value, NULL is an empty field, complex values are json text
+func csvValue(val interface{}) (string, error) {
+	switch v := val.(type) {
+	case nil:
+		return "", nil
+	case string:
+		return v, nil
+	case []byte:
+		return string(v), nil
+	case time.Time:
+		return v.Format(time.RFC3339Nano), nil
+	case bool, int, int8, int16, int32, int64, uint, uint8, uint16, uint32, uint64, float32, float64:
+		return fmt.Sprint(v), nil
+	}
+
+	jsn, err := json.Marshal(val)
+	if err != nil {
+		return "", err
+	}
+
+	// value marshaled to json string
+	var str string
+	if json.Unmarshal(jsn, &str) == nil {
+		return str, nil
+	}
+
+	return string(jsn), nil
+}
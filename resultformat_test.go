@@ -0,0 +1,36 @@
+package main
+
+import "testing"
+
+func TestNegotiateFormat(t *testing.T) {
+	tests := []struct {
+		name   string
+		accept string
+		def    resultFormat
+		want   resultFormat
+	}{
+		{"empty", "", formatCompact, formatCompact},
+		{"unsupported", "text/html, application/xml", formatCompact, formatCompact},
+		{"single", "text/csv", formatJSON, formatCSV},
+		{"first of equal quality", "application/x-ndjson, text/csv", formatJSON, formatNDJSON},
+		{"media type params", "text/csv; charset=utf-8", formatJSON, formatCSV},
+		{"higher quality wins", "text/csv;q=0.1, application/json", formatCSV, formatJSON},
+		{"quality order", "text/csv;q=0.5, application/ndjson;q=0.9, application/json;q=0.7", formatJSON, formatNDJSON},
+		{"zero quality", "text/csv;q=0, application/x-ndjson;q=0.1", formatJSON, formatNDJSON},
+		{"only zero quality", "text/csv;q=0", formatCompact, formatCompact},
+		{"invalid quality", "text/csv;q=x, application/x-ndjson;q=0.2", formatJSON, formatNDJSON},
+		{"any type", "*/*", formatCSV, formatCSV},
+		{"specific type before any type", "*/*, text/csv", formatJSON, formatCSV},
+		{"any type of higher quality", "text/csv;q=0.5, */*", formatCompact, formatCompact},
+		{"browser", "text/html,application/xhtml+xml,application/xml;q=0.9,*/*;q=0.8", formatNDJSON, formatNDJSON},
+		{"invalid item", "text/csv;;;=, application/json", formatCSV, formatJSON},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := negotiateFormat(test.accept, test.def); got != test.want {
+				t.Errorf("format of %q is %v, expected %v", test.accept, got, test.want)
+			}
+		})
+	}
+}
@@ -10,19 +10,38 @@ import (
 	"github.com/google/uuid"
 )
 
+// session manager, server side sessions or stateless tokens
+type sessionManager interface {
+	new(ctx context.Context, data queryParams) (string, time.Time, error) // new session key and expiration
+	check(ctx context.Context, key string) (session, error)
+	refresh(ctx context.Context, key string) (string, session, error)
+	logout(ctx context.Context, key string) error
+	slidingExpiration() bool // session is extended on each request
+	gcStop()
+}
+
+// session data
+type session struct {
+	created time.Time
+	expire  time.Time
+	data    queryParams // login query result row
+}
+
 type sessions struct {
-	list            map[string]time.Time
-	lock            *sync.RWMutex
+	store           sessionStore
 	lifeTime        time.Duration
+	maxLifeTime     time.Duration // absolute session lifetime, 0 is unlimited
+	sliding         bool          // extend expiration on each request
 	contextCancelFn context.CancelFunc
 	wg              sync.WaitGroup
 }
 
-func sessionsNew(ctx context.Context, lifeTime time.Duration) *sessions {
+func sessionsNew(ctx context.Context, lifeTime time.Duration, maxLifeTime time.Duration, sliding bool, store sessionStore) *sessions {
 	var s sessions
-	s.list = make(map[string]time.Time)
+	s.store = store
 	s.lifeTime = lifeTime
-	s.lock = new(sync.RWMutex)
+	s.maxLifeTime = maxLifeTime
+	s.sliding = sliding
 
 	var gcContext context.Context
 	gcContext, s.contextCancelFn = context.WithCancel(ctx)
@@ -47,16 +66,11 @@ func (s *sessions) gc(ctx context.Context, lifeTime time.Duration) {
 			return
 		case <-timer.C:
 			st := time.Now()
-			s.lock.Lock()
-			delCount := 0
-			for session, expire := range s.list {
-				if time.Now().After(expire) {
-					delete(s.list, session)
-					delCount++
-				}
+			delCount, activeCount, err := s.store.deleteExpired(ctx, st)
+			if err != nil {
+				log.Println("Session gc worker error:", err)
+				continue
 			}
-			activeCount := len(s.list)
-			s.lock.Unlock()
 
 			log.Printf("Session gc worker delete %d expired session. Active sessions %d. GC duration %v.\n", delCount, activeCount, time.Now().Sub(st))
 		}
@@ -66,42 +80,86 @@ func (s *sessions) gc(ctx context.Context, lifeTime time.Duration) {
 // create new session
 var errSessionColision = errors.New("Session collision detected")
 
-func (s *sessions) new() (string, time.Time, error) {
+func (s *sessions) new(ctx context.Context, data queryParams) (string, time.Time, error) {
+	now := time.Now()
+	return s.add(ctx, session{created: now, expire: s.expire(now, now), data: data})
+}
+
+// add session with new key
+func (s *sessions) add(ctx context.Context, sess session) (string, time.Time, error) {
 	uuid, err := uuid.NewRandom()
 	if err != nil {
 		return "", time.Time{}, err
 	}
 
 	sesstr := uuid.String()
-	s.lock.RLock()
-	defer s.lock.RUnlock()
-	if _, ok := s.list[sesstr]; ok {
-		return "", time.Time{}, errSessionColision
+	if err := s.store.add(ctx, sesstr, sess); err != nil {
+		return "", time.Time{}, err
 	}
 
-	expire := time.Now().Add(s.lifeTime)
-	s.list[sesstr] = expire
-	return sesstr, expire, nil
+	return sesstr, sess.expire, nil
 }
 
-// check session key
-func (s *sessions) check(session string) bool {
-	s.lock.RLock()
-	defer s.lock.RUnlock()
-	expire, ok := s.list[session]
-	if ok && time.Now().After(expire) {
-		return false
+// session expiration time, not later than max lifetime since creation
+func (s *sessions) expire(created time.Time, now time.Time) time.Time {
+	expire := now.Add(s.lifeTime)
+	if s.maxLifeTime > 0 && expire.After(created.Add(s.maxLifeTime)) {
+		expire = created.Add(s.maxLifeTime)
 	}
-	return ok
+	return expire
 }
 
-// delete session
-func (s *sessions) logout(session string) {
-	if s.check(session) {
-		s.lock.Lock()
-		defer s.lock.Unlock()
-		delete(s.list, session)
+// check session key and return session, in sliding mode session expiration is extended
+func (s *sessions) check(ctx context.Context, key string) (session, error) {
+	sess, ok, err := s.store.get(ctx, key)
+	if err != nil {
+		return session{}, err
+	}
+
+	now := time.Now()
+	if !ok || now.After(sess.expire) {
+		return session{}, errSessionInvalid
+	}
+
+	if s.sliding {
+		if expire := s.expire(sess.created, now); expire.After(sess.expire) {
+			if err := s.store.touch(ctx, key, expire); err != nil {
+				return session{}, err
+			}
+			sess.expire = expire
+		}
 	}
+
+	return sess, nil
+}
+
+// replace session key by new one with renewed expiration
+func (s *sessions) refresh(ctx context.Context, key string) (string, session, error) {
+	sess, err := s.check(ctx, key)
+	if err != nil {
+		return "", session{}, err
+	}
+
+	sess.expire = s.expire(sess.created, time.Now())
+	newKey, _, err := s.add(ctx, sess)
+	if err != nil {
+		return "", session{}, err
+	}
+
+	if err := s.store.delete(ctx, key); err != nil {
+		return "", session{}, err
+	}
+
+	return newKey, sess, nil
+}
+
+// delete session
+func (s *sessions) logout(ctx context.Context, key string) error {
+	return s.store.delete(ctx, key)
+}
+
+func (s *sessions) slidingExpiration() bool {
+	return s.sliding
 }
 
 // stop gc worker
@@ -0,0 +1,391 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v4"
+	"github.com/jackc/pgx/v4/pgxpool"
+)
+
+// session storage backend
+type sessionStore interface {
+	add(ctx context.Context, key string, sess session) error // errSessionColision if key exists
+	get(ctx context.Context, key string) (session, bool, error)
+	touch(ctx context.Context, key string, expire time.Time) error // set new expiration time
+	delete(ctx context.Context, key string) error
+	deleteExpired(ctx context.Context, now time.Time) (int, int, error) // deleted and active sessions count
+}
+
+var errSessionStore = errors.New("Unknown session store")
+
+// create session store by name: memory, postgres or file
+func sessionStoreNew(ctx context.Context, name string, pool *pgxpool.Pool, table string, dir string) (sessionStore, error) {
+	switch strings.ToLower(name) {
+	case "memory", "":
+		return sessionMemoryStoreNew(), nil
+	case "postgres":
+		return sessionPgStoreNew(ctx, pool, table)
+	case "file":
+		return sessionFileStoreNew(dir)
+	}
+
+	return nil, fmt.Errorf("%w: %s", errSessionStore, name)
+}
+
+// session serialization format of persistent stores
+type sessionRecord struct {
+	Created time.Time       `json:"created"`
+	Expire  time.Time       `json:"expire"`
+	Data    json.RawMessage `json:"data"`
+}
+
+func sessionDataDecode(data []byte) (queryParams, error) {
+	var res queryParams
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	if err := dec.Decode(&res); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// in-memory store, sessions are lost on restart
+type sessionMemoryStore struct {
+	list map[string]session
+	lock *sync.RWMutex
+}
+
+func sessionMemoryStoreNew() *sessionMemoryStore {
+	return &sessionMemoryStore{
+		list: make(map[string]session),
+		lock: new(sync.RWMutex),
+	}
+}
+
+func (s *sessionMemoryStore) add(ctx context.Context, key string, sess session) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if _, ok := s.list[key]; ok {
+		return errSessionColision
+	}
+
+	s.list[key] = sess
+	return nil
+}
+
+func (s *sessionMemoryStore) get(ctx context.Context, key string) (session, bool, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	sess, ok := s.list[key]
+	return sess, ok, nil
+}
+
+func (s *sessionMemoryStore) touch(ctx context.Context, key string, expire time.Time) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if sess, ok := s.list[key]; ok {
+		sess.expire = expire
+		s.list[key] = sess
+	}
+	return nil
+}
+
+func (s *sessionMemoryStore) delete(ctx context.Context, key string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	delete(s.list, key)
+	return nil
+}
+
+func (s *sessionMemoryStore) deleteExpired(ctx context.Context, now time.Time) (int, int, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	delCount := 0
+	for key, sess := range s.list {
+		if now.After(sess.expire) {
+			delete(s.list, key)
+			delCount++
+		}
+	}
+
+	return delCount, len(s.list), nil
+}
+
+// postgres table store, shared by all service instances
+type sessionPgStore struct {
+	pool  *pgxpool.Pool
+	table string // sanitized table name
+}
+
+func sessionPgStoreNew(ctx context.Context, pool *pgxpool.Pool, table string) (*sessionPgStore, error) {
+	s := sessionPgStore{
+		pool:  pool,
+		table: pgx.Identifier(strings.Split(table, ".")).Sanitize(),
+	}
+
+	if _, err := pool.Exec(ctx, "create table if not exists "+s.table+
+		" (key text primary key, created timestamptz not null default now(), expire timestamptz not null, data jsonb not null)"); err != nil {
+		return nil, err
+	}
+
+	return &s, nil
+}
+
+func (s *sessionPgStore) add(ctx context.Context, key string, sess session) error {
+	data, err := json.Marshal(sess.data)
+	if err != nil {
+		return err
+	}
+
+	tag, err := s.pool.Exec(ctx, "insert into "+s.table+" (key, created, expire, data) values ($1, $2, $3, $4) on conflict do nothing",
+		key, sess.created, sess.expire, string(data))
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return errSessionColision
+	}
+
+	return nil
+}
+
+func (s *sessionPgStore) get(ctx context.Context, key string) (session, bool, error) {
+	var sess session
+	var data string
+	err := s.pool.QueryRow(ctx, "select created, expire, data::text from "+s.table+" where key = $1", key).Scan(&sess.created, &sess.expire, &data)
+	if err == pgx.ErrNoRows {
+		return session{}, false, nil
+	}
+	if err != nil {
+		return session{}, false, err
+	}
+
+	if sess.data, err = sessionDataDecode([]byte(data)); err != nil {
+		return session{}, false, err
+	}
+
+	return sess, true, nil
+}
+
+func (s *sessionPgStore) touch(ctx context.Context, key string, expire time.Time) error {
+	_, err := s.pool.Exec(ctx, "update "+s.table+" set expire = $2 where key = $1", key, expire)
+	return err
+}
+
+func (s *sessionPgStore) delete(ctx context.Context, key string) error {
+	_, err := s.pool.Exec(ctx, "delete from "+s.table+" where key = $1", key)
+	return err
+}
+
+func (s *sessionPgStore) deleteExpired(ctx context.Context, now time.Time) (int, int, error) {
+	tag, err := s.pool.Exec(ctx, "delete from "+s.table+" where expire < $1", now)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	var activeCount int
+	if err := s.pool.QueryRow(ctx, "select count(*) from "+s.table).Scan(&activeCount); err != nil {
+		return 0, 0, err
+	}
+
+	return int(tag.RowsAffected()), activeCount, nil
+}
+
+// local file store, one json file per session, survives restarts
+type sessionFileStore struct {
+	dir  string
+	lock *sync.Mutex // touch, delete and gc, so deleted session is never written back
+}
+
+func sessionFileStoreNew(dir string) (*sessionFileStore, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+
+	return &sessionFileStore{dir: dir, lock: new(sync.Mutex)}, nil
+}
+
+// session file path, key is checked so the client can't read other files
+func (s *sessionFileStore) path(key string) (string, bool) {
+	if _, err := uuid.Parse(key); err != nil {
+		return "", false
+	}
+
+	return filepath.Join(s.dir, key+".json"), true
+}
+
+// write session to temp file, caller links or renames it to session file
+func (s *sessionFileStore) write(sess session) (string, error) {
+	data, err := json.Marshal(sess.data)
+	if err != nil {
+		return "", err
+	}
+	jsn, err := json.Marshal(sessionRecord{Created: sess.created, Expire: sess.expire, Data: data})
+	if err != nil {
+		return "", err
+	}
+
+	tmp, err := ioutil.TempFile(s.dir, ".session")
+	if err != nil {
+		return "", err
+	}
+
+	if _, err := tmp.Write(jsn); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return "", err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return "", err
+	}
+
+	return tmp.Name(), nil
+}
+
+func (s *sessionFileStore) add(ctx context.Context, key string, sess session) error {
+	path, ok := s.path(key)
+	if !ok {
+		return errSessionInvalid
+	}
+
+	// link temp file, so readers never see a partial file and existing session is not overwritten
+	tmp, err := s.write(sess)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp)
+
+	if err := os.Link(tmp, path); err != nil {
+		if os.IsExist(err) {
+			return errSessionColision
+		}
+		return err
+	}
+
+	return nil
+}
+
+func (s *sessionFileStore) touch(ctx context.Context, key string, expire time.Time) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	sess, ok, err := s.get(ctx, key)
+	if err != nil || !ok {
+		return err
+	}
+	sess.expire = expire
+
+	tmp, err := s.write(sess)
+	if err != nil {
+		return err
+	}
+
+	// session file can be deleted by another instance sharing the directory
+	path, _ := s.path(key)
+	if _, err := os.Stat(path); err != nil {
+		os.Remove(tmp)
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	return nil
+}
+
+func (s *sessionFileStore) read(path string) (session, error) {
+	jsn, err := ioutil.ReadFile(path)
+	if err != nil {
+		return session{}, err
+	}
+
+	var rec sessionRecord
+	if err := json.Unmarshal(jsn, &rec); err != nil {
+		return session{}, err
+	}
+
+	sess := session{created: rec.Created, expire: rec.Expire}
+	if sess.data, err = sessionDataDecode(rec.Data); err != nil {
+		return session{}, err
+	}
+
+	return sess, nil
+}
+
+func (s *sessionFileStore) get(ctx context.Context, key string) (session, bool, error) {
+	path, ok := s.path(key)
+	if !ok {
+		return session{}, false, nil
+	}
+
+	sess, err := s.read(path)
+	if os.IsNotExist(err) {
+		return session{}, false, nil
+	}
+	if err != nil {
+		return session{}, false, err
+	}
+
+	return sess, true, nil
+}
+
+func (s *sessionFileStore) delete(ctx context.Context, key string) error {
+	path, ok := s.path(key)
+	if !ok {
+		return nil
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+func (s *sessionFileStore) deleteExpired(ctx context.Context, now time.Time) (int, int, error) {
+	files, err := filepath.Glob(filepath.Join(s.dir, "*.json"))
+	if err != nil {
+		return 0, 0, err
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	delCount, activeCount := 0, 0
+	for _, path := range files {
+		sess, err := s.read(path)
+		if os.IsNotExist(err) {
+			continue
+		}
+
+		// broken files are deleted too
+		if err != nil || now.After(sess.expire) {
+			if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+				return delCount, activeCount, err
+			}
+			delCount++
+			continue
+		}
+		activeCount++
+	}
+
+	return delCount, activeCount, nil
+}
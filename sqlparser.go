@@ -9,6 +9,9 @@ import (
 	"strconv"
 	"strings"
 	"time"
+	"unicode"
+
+	"github.com/jackc/pgx/v4"
 )
 
 // Oh dear... A little bit of unicorn shit 🦄💩
@@ -18,31 +21,45 @@ const (
 		`(?P<identstrings>"(?:[^"\\]|\\.)*")|` +
 		`(?P<dollarstrings>(?s)\$\w*?\$.*?\$\w*?\$)|` + // maybe buggy
 		`(?P<typeconv>::\w*)|` + // just a pg type conversion fix
-		`:(?P<params>[_a-zA-Z]\w*)` // FINALLY!!1!!1111!
+		`:(?P<params>[_a-zA-Z]\w*)|` + // FINALLY!!1!!1111!
+		`(?P<semicolon>;)` // statements delimiter
 
 	dirExpStr = `(?is)#(?P<directivename>\w*?):(?P<directivebody>.*?)##`
 
-	dirParamExpStr = `(?P<key>[_a-zA-Z]\w*)\s*=\s*(?s)(?P<value>.*?)\s*;`
+	// statement code without comments and strings
+	selectExpStr = `(?i)^\s*(select|with|table|values)\b`
+	writeExpStr  = `(?i)\b(insert|update|delete|merge|into|share|lock|nextval|setval)\b`
+	funcExpStr   = `([a-zA-Z_][\w$]*)\s*\(`
+
+	dirParamExpStr = `(?P<key>[_a-zA-Z]\w*)(?P<attrs>[^=;]*?)\s*=\s*(?s)(?P<value>.*?)\s*;`
 )
 
 const (
 	expCommentaryGrp = 1
+	expIdentGrp      = 3
 	expParamsGrp     = 6
+	expSemicolonGrp  = 7
 	expDirNameGrp    = 1
 	expDirBodyGrp    = 2
 	expKeyGrp        = 1
-	expValueGrp      = 2
+	expAttrsGrp      = 2
+	expValueGrp      = 3
 )
 
 type sqlParser struct {
-	mainExp  *regexp.Regexp
-	dirExp   *regexp.Regexp
-	paramExp *regexp.Regexp
+	mainExp   *regexp.Regexp
+	dirExp    *regexp.Regexp
+	paramExp  *regexp.Regexp
+	selectExp *regexp.Regexp
+	writeExp  *regexp.Regexp
+	funcExp   *regexp.Regexp
+	dbDirs    databaseDirs    // default databases of subdirectories
+	databases map[string]bool // known database names
 }
 
-func sqlParserNew() (*sqlParser, error) {
+func sqlParserNew(dbDirs databaseDirs, databases map[string]bool) (*sqlParser, error) {
 	var err error
-	var p sqlParser
+	p := sqlParser{dbDirs: dbDirs, databases: databases}
 
 	if p.mainExp, err = regexp.Compile(mainExpStr); err != nil {
 		return nil, err
@@ -56,6 +73,18 @@ func sqlParserNew() (*sqlParser, error) {
 		return nil, err
 	}
 
+	if p.selectExp, err = regexp.Compile(selectExpStr); err != nil {
+		return nil, err
+	}
+
+	if p.writeExp, err = regexp.Compile(writeExpStr); err != nil {
+		return nil, err
+	}
+
+	if p.funcExp, err = regexp.Compile(funcExpStr); err != nil {
+		return nil, err
+	}
+
 	return &p, nil
 }
 
@@ -64,47 +93,62 @@ func (p *sqlParser) parse(str string, res *query) {
 	res.loadtime = time.Now()
 	res.testpass = testPassNoError //by deafault
 
-	// read sql input parameters and construct commentary string
+	// read sql input parameters, split statements and construct commentary string
 	cmtstr := ""
-	lastParamEnd := 0
+	pos := 0
+	var stmts []*sqlStatementParts
+	stmt := &sqlStatementParts{}
 	for _, match := range p.mainExp.FindAllStringSubmatchIndex(str, -1) {
-		// concat commentary string
-		cmtbgn := match[expCommentaryGrp*2]
-		cmtend := match[expCommentaryGrp*2+1]
-
-		if cmtbgn != -1 && cmtend != -1 {
-			cmtstr += str[cmtbgn:cmtend] + "\n"
-		}
+		stmt.addText(str[pos:match[0]])
+		stmt.code += str[pos:match[0]]
+		pos = match[1]
 
+		switch {
+		// concat commentary string
+		case match[expCommentaryGrp*2] != -1:
+			cmtstr += str[match[0]:match[1]] + "\n"
+			stmt.parts[len(stmt.parts)-1] += str[match[0]:match[1]]
 		// read sql parameters and replace named params on positional params
-		parambgn := match[expParamsGrp*2]
-		paramend := match[expParamsGrp*2+1]
-
-		if parambgn != -1 && paramend != -1 {
-			paramname := strings.ToLower(str[parambgn:paramend])
+		case match[expParamsGrp*2] != -1:
+			paramname := strings.ToLower(str[match[expParamsGrp*2]:match[expParamsGrp*2+1]])
 			found, i := res.params.find(paramname)
 			if !found {
-				res.params = append(res.params, paramname)
+				res.params = append(res.params, sqlParam{name: paramname})
 				i = len(res.params) - 1
 			}
 
-			// param at begining ?
-			if (parambgn - 1) > 0 { // -1 cause param have ":" prefix
-				res.body += str[lastParamEnd : parambgn-1]
+			stmt.params = append(stmt.params, i)
+			stmt.parts = append(stmt.parts, "")
+			stmt.code += " $ "
+			stmt.hasCode = true
+		// end of statement
+		case match[expSemicolonGrp*2] != -1:
+			if stmt.hasCode {
+				stmts = append(stmts, stmt)
+			}
+			stmt = &sqlStatementParts{}
+		// strings and type conversions, quoted identifier can be a function name
+		default:
+			stmt.addText(str[match[0]:match[1]])
+			if match[expIdentGrp*2] != -1 {
+				stmt.code += " _ident_ "
 			}
-			res.body += "$" + strconv.Itoa(i+1)
-
-			lastParamEnd = paramend
-
 		}
 	}
+	stmt.addText(str[pos:])
+	stmt.code += str[pos:]
+	if stmt.hasCode {
+		stmts = append(stmts, stmt)
+	}
+
+	resultStmt := len(stmts)
 
-	if lastParamEnd != len(str)-1 {
-		upBound := len(str) - 1
-		if upBound < 0 {
-			upBound = 0
+	// plain selects don't change data
+	res.plainSelect = len(stmts) > 0
+	for _, stmt := range stmts {
+		if !p.isPlainSelect(stmt.code) {
+			res.plainSelect = false
 		}
-		res.body += str[lastParamEnd:upBound]
 	}
 
 	// parse directives
@@ -121,12 +165,68 @@ func (p *sqlParser) parse(str string, res *query) {
 			} else {
 				res.parsewarn += fmt.Sprintln("Can't parse timeout, value is ", dirbody)
 			}
+		case "format":
+			var format resultFormat
+			if err := format.parse(strings.ToLower(dirbody)); err != nil {
+				res.parsewarn += fmt.Sprintln("Can't parse format value: ", err, ". Use default json format")
+				continue
+			}
+
+			res.format = format
+		case "stream":
+			if stream, err := strconv.ParseBool(dirbody); err == nil {
+				res.stream = &stream
+			} else {
+				res.parsewarn += fmt.Sprintln("Can't parse stream, value is ", dirbody)
+			}
+		case "result":
+			if result, err := strconv.Atoi(dirbody); err == nil && result >= 1 && result <= len(stmts) {
+				resultStmt = result
+			} else {
+				res.parsewarn += fmt.Sprintln("Can't parse result statement number, value is ", dirbody, ". Use the last statement")
+			}
+		case "isolation":
+			isolation := strings.Join(strings.Fields(strings.ToLower(strings.ReplaceAll(dirbody, "_", " "))), " ")
+			switch pgx.TxIsoLevel(isolation) {
+			case pgx.Serializable, pgx.RepeatableRead, pgx.ReadCommitted, pgx.ReadUncommitted:
+				res.txOptions.IsoLevel = pgx.TxIsoLevel(isolation)
+			default:
+				res.parsewarn += fmt.Sprintln("Can't parse isolation, value is ", dirbody)
+			}
+		case "readonly":
+			if readOnly, err := strconv.ParseBool(dirbody); err != nil {
+				res.parsewarn += fmt.Sprintln("Can't parse readonly, value is ", dirbody)
+			} else if readOnly {
+				res.txOptions.AccessMode = pgx.ReadOnly
+			} else {
+				res.txOptions.AccessMode = pgx.ReadWrite
+			}
+		case "deferrable":
+			if deferrable, err := strconv.ParseBool(dirbody); err != nil {
+				res.parsewarn += fmt.Sprintln("Can't parse deferrable, value is ", dirbody)
+			} else if deferrable {
+				res.txOptions.DeferrableMode = pgx.Deferrable
+			} else {
+				res.txOptions.DeferrableMode = pgx.NotDeferrable
+			}
+		case "access":
+			// query with broken access rules is denied to everyone
+			if err := res.access.parse(dirbody); err != nil {
+				res.access = queryAccess{mode: accessRules}
+				res.err = fmt.Errorf("%w: %v", errAccessParse, err)
+			}
+		case "limit":
+			if err := res.limits.parse(dirbody); err != nil {
+				res.parsewarn += fmt.Sprintln("Can't parse limit: ", err, ". Use default limits")
+			}
+		case "database":
+			res.database = strings.ToLower(dirbody)
 		case "in":
-			res.in.readIn(p.paramExp, dirbody, expKeyGrp, expValueGrp)
+			res.parsewarn += res.in.readIn(p.paramExp, dirbody, expKeyGrp, expAttrsGrp, expValueGrp)
 		case "out":
-			res.out.readIn(p.paramExp, dirbody, expKeyGrp, expValueGrp)
+			res.parsewarn += res.out.readIn(p.paramExp, dirbody, expKeyGrp, expAttrsGrp, expValueGrp)
 		case "test":
-			res.testparams.readIn(p.paramExp, dirbody, expKeyGrp, expValueGrp)
+			res.parsewarn += res.testparams.readIn(p.paramExp, dirbody, expKeyGrp, expAttrsGrp, expValueGrp)
 		case "testpass":
 			// available values testpass
 			var testPass queryTestPassType
@@ -139,6 +239,95 @@ func (p *sqlParser) parse(str string, res *query) {
 			res.testpass = testPass
 		}
 	}
+
+	// input params types and modes
+	for _, param := range res.in {
+		found, i := res.params.find(param.key)
+		if !found {
+			continue
+		}
+
+		res.params[i].mode = param.mode
+		res.params[i].defval = param.defval
+
+		if param.ptype != "" {
+			ptype, err := paramTypeParse(param.ptype)
+			if err != nil {
+				res.parsewarn += fmt.Sprintln("Can't parse type of input parameter ", param.key, ": ", err, " ", param.ptype)
+			} else {
+				res.params[i].ptype = ptype
+			}
+		}
+
+		if param.mode == paramModeDefault {
+			if _, err := res.params[i].convert([]string{param.defval}); err != nil {
+				res.parsewarn += fmt.Sprintln("Invalid default value of input parameter ", param.key, ": ", err)
+			}
+		}
+	}
+
+	// construct statements, typed params are casted to declared type
+	for _, parts := range stmts {
+		res.statements = append(res.statements, parts.build(res.params))
+	}
+	res.result = resultStmt - 1
+
+	if len(res.statements) == 0 {
+		res.parsewarn += fmt.Sprintln("Query is empty")
+	}
+}
+
+// statement text parts between params
+type sqlStatementParts struct {
+	parts   []string // statement text between params
+	params  []int    // param index after each part of statement text
+	hasCode bool     // statement has something but comments and spaces
+	code    string   // statement text without comments and strings
+}
+
+func (stmt *sqlStatementParts) addText(text string) {
+	if len(stmt.parts) == 0 {
+		stmt.parts = append(stmt.parts, "")
+	}
+	stmt.parts[len(stmt.parts)-1] += text
+
+	if strings.TrimSpace(text) != "" {
+		stmt.hasCode = true
+	}
+}
+
+// statement body with positional params
+func (stmt *sqlStatementParts) build(params paramList) sqlStatement {
+	var res sqlStatement
+	for i, part := range stmt.parts {
+		res.body += part
+		if i >= len(stmt.params) {
+			break
+		}
+
+		// statement params are numbered in order of appearance
+		found := false
+		pos := 0
+		for j, index := range res.params {
+			if index == stmt.params[i] {
+				found, pos = true, j
+				break
+			}
+		}
+		if !found {
+			res.params = append(res.params, stmt.params[i])
+			pos = len(res.params) - 1
+		}
+
+		param := params[stmt.params[i]]
+		res.body += "$" + strconv.Itoa(pos+1)
+		if param.ptype != nil {
+			res.body += "::" + param.ptype.cast
+		}
+	}
+	res.body = strings.TrimRightFunc(res.body, unicode.IsSpace)
+
+	return res
 }
 
 func (p *sqlParser) loadSQLFiles(sqlpath string, ignorerrors bool) (map[string]*query, error) {
@@ -157,25 +346,15 @@ func (p *sqlParser) loadSQLFiles(sqlpath string, ignorerrors bool) (map[string]*
 		}
 
 		// skip dir and not sql files
-		if file.IsDir() || strings.ToLower(filepath.Ext(path)) != ".sql" {
+		if file.IsDir() || !isSQLFile(path) {
 			return nil
 		}
 
-		// init query
-		name := path[len(sqlroot):]
-		name = strings.TrimSuffix(name, filepath.Ext(name))
-		q := query{name: name}
-
-		// read sql file
-		if bin, errio := ioutil.ReadFile(path); errio == nil {
-			p.parse(string(bin), &q)
-		} else {
-			if !ignorerrors {
-				return errio
-			}
-			q.err = errio
+		q := p.loadSQLFile(sqlroot, path)
+		if q.err != nil && !ignorerrors {
+			return fmt.Errorf("%s: %w", q.name, q.err)
 		}
-		qlist[q.name] = &q
+		qlist[q.name] = q
 
 		return nil
 	}
@@ -186,3 +365,73 @@ func (p *sqlParser) loadSQLFiles(sqlpath string, ignorerrors bool) (map[string]*
 
 	return qlist, nil
 }
+
+// words followed by parenthesis that are not function calls
+var sqlNotFunctions = map[string]bool{
+	"all": true, "and": true, "any": true, "array": true, "as": true, "between": true, "by": true, "case": true,
+	"cast": true, "distinct": true, "else": true, "except": true, "exists": true, "filter": true, "from": true,
+	"group": true, "having": true, "in": true, "intersect": true, "is": true, "join": true, "lateral": true,
+	"like": true, "limit": true, "not": true, "offset": true, "on": true, "or": true, "over": true, "row": true,
+	"select": true, "some": true, "then": true, "union": true, "using": true, "values": true, "when": true,
+	"where": true, "with": true, "within": true,
+}
+
+// built-in functions that don't change data, any other function can write
+var sqlReadFunctions = map[string]bool{
+	"abs": true, "array_agg": true, "avg": true, "ceil": true, "coalesce": true, "count": true, "date_part": true,
+	"date_trunc": true, "dense_rank": true, "extract": true, "floor": true, "greatest": true, "json_agg": true,
+	"json_build_object": true, "jsonb_agg": true, "jsonb_build_object": true, "least": true, "length": true,
+	"lower": true, "max": true, "min": true, "now": true, "nullif": true, "rank": true, "round": true,
+	"row_number": true, "string_agg": true, "substring": true, "sum": true, "to_char": true, "to_date": true,
+	"to_timestamp": true, "trim": true, "upper": true,
+}
+
+// statement code is a select that doesn't change data
+func (p *sqlParser) isPlainSelect(code string) bool {
+	if !p.selectExp.MatchString(code) || p.writeExp.MatchString(code) {
+		return false
+	}
+
+	for _, match := range p.funcExp.FindAllStringSubmatch(code, -1) {
+		name := strings.ToLower(match[1])
+		if !sqlNotFunctions[name] && !sqlReadFunctions[name] {
+			return false
+		}
+	}
+	return true
+}
+
+// read and parse single sql file
+func (p *sqlParser) loadSQLFile(sqlroot string, path string) *query {
+	// init query
+	q := query{name: queryName(sqlroot, path)}
+
+	// read sql file
+	if bin, errio := ioutil.ReadFile(path); errio == nil {
+		p.parse(string(bin), &q)
+		if q.database == "" {
+			q.database = p.dbDirs.find(q.name)
+		}
+
+		// client gets error without database name, it is shown in doc
+		if !p.databases[q.databaseName()] {
+			q.parsewarn += fmt.Sprintln("Unknown database ", q.databaseName())
+			q.err = errDatabaseNotFound
+		}
+	} else {
+		q.loadtime = time.Now()
+		q.err = errio
+	}
+
+	return &q
+}
+
+// query name is a file path relative to sql root without extension
+func queryName(sqlroot string, path string) string {
+	name := path[len(strings.TrimSuffix(sqlroot, "/")):]
+	return strings.TrimSuffix(name, filepath.Ext(name))
+}
+
+func isSQLFile(path string) bool {
+	return strings.ToLower(filepath.Ext(path)) == ".sql"
+}
@@ -0,0 +1,54 @@
+package main
+
+import "testing"
+
+func TestPlainSelect(t *testing.T) {
+	tests := []struct {
+		name  string
+		sql   string
+		plain bool
+	}{
+		{"select", "select id, name from users where id = :id", true},
+		{"multiple selects", "select 1; select 2", true},
+		{"with", "with t as (select 1 as a) select a from t", true},
+		{"table", "table users", true},
+		{"values", "values (1), (2)", true},
+		{"built-in functions", "select count(*), coalesce(max(id), 0), lower(name) from users group by name", true},
+		{"subquery", "select * from (select id from users) u where id in (select 1) and exists (select 1)", true},
+		{"window", "select row_number() over (partition by a order by b) from t", true},
+		{"cast", "select cast(:id as int), :name::text", true},
+		{"keywords in comments", "-- update insert\nselect 1 /* delete */", true},
+		{"keywords in strings", "select 'insert into t', $$delete$$", true},
+		{"insert", "insert into users (name) values (:name)", false},
+		{"update", "update users set name = :name", false},
+		{"delete", "delete from users", false},
+		{"select into", "select * into backup from users", false},
+		{"for update", "select * from users for update", false},
+		{"for share", "select * from users for key share", false},
+		{"data modifying cte", "with d as (delete from t returning *) select * from d", false},
+		{"nextval", "select nextval('seq')", false},
+		{"function call", "select create_order(:user_id, :amount)", false},
+		{"schema function call", "select app.create_order(:user_id)", false},
+		{"function in from", "select * from create_order(:user_id)", false},
+		{"quoted function call", `select "CreateOrder"(:user_id)`, false},
+		{"function with space", "select create_order (:user_id)", false},
+		{"select and insert", "select 1; insert into t values (1)", false},
+		{"empty", "-- nothing", false},
+		{"call", "call do_something()", false},
+	}
+
+	p, err := sqlParserNew(nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var q query
+			p.parse(test.sql, &q)
+			if q.plainSelect != test.plain {
+				t.Errorf("plainSelect of %q is %v, expected %v", test.sql, q.plainSelect, test.plain)
+			}
+		})
+	}
+}
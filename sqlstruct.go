@@ -5,14 +5,20 @@ import (
 	"fmt"
 	"net/url"
 	"regexp"
+	"sort"
 	"strings"
 	"time"
+
+	"github.com/jackc/pgx/v4"
 )
 
 // Directive types
 type dirParam struct {
-	key   string
-	value string
+	key    string
+	ptype  string
+	mode   paramMode
+	defval string
+	value  string
 }
 
 type dirParamList []dirParam
@@ -27,7 +33,8 @@ func (list dirParamList) find(key string) (bool, int) {
 	return false, -1
 }
 
-func (list *dirParamList) readIn(regExp *regexp.Regexp, str string, keyGrp int, valueGrp int) {
+func (list *dirParamList) readIn(regExp *regexp.Regexp, str string, keyGrp int, attrsGrp int, valueGrp int) string {
+	var warn string
 	for _, match := range regExp.FindAllStringSubmatch(str, -1) {
 		key := strings.ToLower(match[keyGrp])
 		value := match[valueGrp]
@@ -36,11 +43,54 @@ func (list *dirParamList) readIn(regExp *regexp.Regexp, str string, keyGrp int,
 			continue
 		}
 
+		ptype, mode, defval, err := parseParamAttrs(match[attrsGrp])
+		if err != nil {
+			warn += fmt.Sprintln("Can't parse parameter ", key, ": ", err)
+		}
+
 		found, _ := list.find(key)
 		if !found {
-			*list = append(*list, dirParam{key, value})
+			*list = append(*list, dirParam{key, ptype, mode, defval, value})
 		}
 	}
+
+	return warn
+}
+
+// parse param attributes: [type] [required|optional] [default value]
+var defaultAttrExp = regexp.MustCompile(`(?i)(?:^|\s)default\s+(.*)$`)
+
+func parseParamAttrs(attrs string) (string, paramMode, string, error) {
+	var ptype, defval string
+	mode := paramModeNullable
+
+	if match := defaultAttrExp.FindStringSubmatchIndex(attrs); match != nil {
+		mode = paramModeDefault
+		defval = strings.TrimSpace(attrs[match[2]:match[3]])
+		if len(defval) >= 2 && strings.HasPrefix(defval, "'") && strings.HasSuffix(defval, "'") {
+			defval = strings.ReplaceAll(defval[1:len(defval)-1], "''", "'")
+		}
+		attrs = attrs[:match[0]]
+	}
+
+	for _, attr := range strings.Fields(strings.ToLower(attrs)) {
+		switch {
+		case attr == paramModeRequired.String() || attr == paramModeOptional.String():
+			if mode != paramModeNullable {
+				return "", paramModeNullable, "", errors.New("Parameter mode is already set, unexpected " + attr)
+			}
+			mode = paramModeRequired
+			if attr == paramModeOptional.String() {
+				mode = paramModeOptional
+			}
+		case ptype == "":
+			ptype = attr
+		default:
+			return "", paramModeNullable, "", errors.New("Unexpected parameter attribute " + attr)
+		}
+	}
+
+	return ptype, mode, defval, nil
 }
 
 func (list dirParamList) toURLValues() url.Values {
@@ -53,12 +103,33 @@ func (list dirParamList) toURLValues() url.Values {
 	return res
 }
 
+// Input param mode
+type paramMode int
+
+const (
+	paramModeNullable paramMode = iota // not sent or empty parameter is NULL
+	paramModeRequired                  // parameter must be sent
+	paramModeOptional                  // not sent parameter is NULL
+	paramModeDefault                   // not sent parameter has default value
+)
+
+func (m paramMode) String() string {
+	return [...]string{"nullable", "required", "optional", "default"}[m]
+}
+
 // SQL param type
-type paramList []string
+type sqlParam struct {
+	name   string
+	ptype  *paramType // declared in "in" directive type, nil if not declared
+	mode   paramMode  // declared in "in" directive mode
+	defval string     // default value for paramModeDefault
+}
+
+type paramList []sqlParam
 
 func (list paramList) find(name string) (bool, int) {
 	for i, param := range list {
-		if param == name {
+		if param.name == name {
 			return true, i
 		}
 	}
@@ -66,46 +137,125 @@ func (list paramList) find(name string) (bool, int) {
 	return false, -1
 }
 
-func (list paramList) prepare(urlparam url.Values, filterInParams bool) ([]interface{}, error) {
+// convert request value to query argument
+func (param sqlParam) convert(val interface{}) (interface{}, error) {
+	// form values
+	if form, ok := val.([]string); ok {
+		if param.ptype == nil {
+			return form[0], nil
+		}
+		return param.convertStrings(form)
+	}
+
+	// json values
+	if param.ptype == nil {
+		str, err := jsonValueString(val)
+		if err != nil {
+			return nil, &paramError{param.name, err}
+		}
+		return str, nil
+	}
+
+	strs, err := jsonValueStrings(val, param.ptype)
+	if err != nil {
+		return nil, &paramError{param.name, err}
+	}
+	return param.convertStrings(strs)
+}
+
+func (param sqlParam) convertStrings(val []string) (interface{}, error) {
+	cval, err := param.ptype.convert(val)
+	if err != nil {
+		return nil, &paramError{param.name, err}
+	}
+
+	return cval, nil
+}
+
+func (list paramList) prepare(urlparam queryParams, filterInParams bool) ([]interface{}, error) {
 	res := make([]interface{}, 0)
+	var missing paramsMissingError
 
-	for _, name := range list {
-		val, ok := urlparam[name]
+	for _, param := range list {
+		val, ok := urlparam[param.name]
 
-		if ok {
-			if filterInParams {
-				delete(urlparam, name)
+		if ok && filterInParams {
+			delete(urlparam, param.name)
+		}
+
+		// null or empty value, empty value of text param is an empty string if param mode is declared
+		if ok && (val == nil || (paramIsEmpty(val) && (param.mode == paramModeNullable || !param.ptype.isText()))) {
+			ok = false
+			if param.mode != paramModeRequired {
+				res = append(res, nil)
+				continue
 			}
+		}
 
-			if val[0] != "" {
-				res = append(res, val[0])
+		if !ok {
+			switch param.mode {
+			case paramModeRequired:
+				missing = append(missing, param.name)
+				res = append(res, nil)
+				continue
+			case paramModeDefault:
+				val = []string{param.defval}
+			default:
+				res = append(res, nil)
 				continue
 			}
 		}
 
-		res = append(res, nil)
+		cval, err := param.convert(val)
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, cval)
+	}
+
+	if len(missing) > 0 {
+		return nil, missing
 	}
 
 	if filterInParams && len(urlparam) > 0 {
-		var pstr string
+		var unknown paramsUnknownError
 		for k := range urlparam {
-			if pstr == "" {
-				pstr = k
-				continue
+			// session params are passed to every query
+			if !strings.HasPrefix(k, sessionParamPrefix) {
+				unknown = append(unknown, k)
 			}
-
-			pstr += ", " + k
 		}
+		sort.Strings(unknown)
 
-		return nil, errors.New(fmt.Sprint("Unknow input parameters: ", pstr))
+		if len(unknown) > 0 {
+			return nil, unknown
+		}
 	}
 	return res, nil
 }
 
+// SQL statement
+type sqlStatement struct {
+	body   string // statement with positional params
+	params []int  // query params indexes, statement param $n is query param params[n-1]
+}
+
+// statement arguments from prepared query params
+func (stmt sqlStatement) args(prms []interface{}) []interface{} {
+	res := make([]interface{}, len(stmt.params))
+	for i, index := range stmt.params {
+		res[i] = prms[index]
+	}
+	return res
+}
+
 // Query type
 type query struct {
 	name        string            // relative file path
-	body        string            // sql query
+	statements  []sqlStatement    // sql statements executed in one transaction
+	result      int               // index of statement which rows are returned
+	txOptions   pgx.TxOptions     // transaction isolation, access and deferrable modes
+	plainSelect bool              // all statements are plain selects, query can run on replica
 	params      paramList         // parsed params names from query
 	description string            // query description
 	in          dirParamList      // parsed input params description
@@ -113,8 +263,14 @@ type query struct {
 	testparams  dirParamList      // parsed test scenario params
 	testpass    queryTestPassType // condition for a successful test scenario (see testPassValueList)
 	timeout     *time.Duration    // query timeout
+	format      resultFormat      // default result format
+	stream      *bool             // stream result rows to client
+	access      queryAccess       // access rules
+	limits      queryLimits       // rate and concurrency limits over global config
+	database    string            // named database connection, empty is dburl
 	loadtime    time.Time         // when was the request parsing from a file
 	parsewarn   string            // parse warnings
 	testreport  *queryTestReport  // autotest report
 	err         error             // error duryng loading/testing query
+	reloaderr   error             // error during hot reload, previous version of query is used
 }
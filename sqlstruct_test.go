@@ -0,0 +1,129 @@
+package main
+
+import (
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParamListPrepare(t *testing.T) {
+	tests := []struct {
+		name   string
+		ptype  string // declared type, empty for untyped param
+		mode   paramMode
+		defval string
+		json   bool   // input is json body, otherwise form
+		input  string // url encoded form or json object
+		want   interface{}
+		err    string // expected error: missing, invalid or unknown
+	}{
+		// untyped params
+		{"untyped nullable form missing", "", paramModeNullable, "", false, "", nil, ""},
+		{"untyped nullable form empty", "", paramModeNullable, "", false, "p=", nil, ""},
+		{"untyped nullable form value", "", paramModeNullable, "", false, "p=a", "a", ""},
+		{"untyped nullable json empty", "", paramModeNullable, "", true, `{"p": ""}`, nil, ""},
+		{"untyped nullable json null", "", paramModeNullable, "", true, `{"p": null}`, nil, ""},
+		{"untyped nullable json number", "", paramModeNullable, "", true, `{"p": 1.50}`, "1.50", ""},
+		{"untyped nullable json object", "", paramModeNullable, "", true, `{"p": {"a": [1, 2]}}`, `{"a":[1,2]}`, ""},
+		{"untyped required form missing", "", paramModeRequired, "", false, "", nil, "missing"},
+		{"untyped required form empty", "", paramModeRequired, "", false, "p=", "", ""},
+		{"untyped required json null", "", paramModeRequired, "", true, `{"p": null}`, nil, "missing"},
+		{"untyped required json empty", "", paramModeRequired, "", true, `{"p": ""}`, "", ""},
+		{"untyped optional form missing", "", paramModeOptional, "", false, "", nil, ""},
+		{"untyped optional form empty", "", paramModeOptional, "", false, "p=", "", ""},
+		{"untyped optional json bool", "", paramModeOptional, "", true, `{"p": true}`, "true", ""},
+		{"untyped default form missing", "", paramModeDefault, "x", false, "", "x", ""},
+		{"untyped default form empty", "", paramModeDefault, "x", false, "p=", "", ""},
+		{"untyped default json missing", "", paramModeDefault, "x", true, `{}`, "x", ""},
+		{"untyped default json null", "", paramModeDefault, "x", true, `{"p": null}`, nil, ""},
+
+		// typed params
+		{"int nullable form empty", "int", paramModeNullable, "", false, "p=", nil, ""},
+		{"int nullable form value", "int", paramModeNullable, "", false, "p=+5", int64(5), ""},
+		{"int nullable form invalid", "int", paramModeNullable, "", false, "p=a", nil, "invalid"},
+		{"int nullable json number", "int", paramModeNullable, "", true, `{"p": 5}`, int64(5), ""},
+		{"int nullable json string", "int", paramModeNullable, "", true, `{"p": "5"}`, int64(5), ""},
+		{"int nullable json array", "int", paramModeNullable, "", true, `{"p": [5]}`, nil, "invalid"},
+		{"int nullable json object", "int", paramModeNullable, "", true, `{"p": {}}`, nil, "invalid"},
+		{"smallint form overflow", "smallint", paramModeNullable, "", false, "p=40000", nil, "invalid"},
+		{"int required form missing", "int", paramModeRequired, "", false, "", nil, "missing"},
+		{"int required form empty", "int", paramModeRequired, "", false, "p=", nil, "missing"},
+		{"int required json empty", "int", paramModeRequired, "", true, `{"p": ""}`, nil, "missing"},
+		{"int optional form missing", "int", paramModeOptional, "", false, "", nil, ""},
+		{"int optional form empty", "int", paramModeOptional, "", false, "p=", nil, ""},
+		{"int default form missing", "int", paramModeDefault, "7", false, "", int64(7), ""},
+		{"int default form empty", "int", paramModeDefault, "7", false, "p=", nil, ""},
+		{"int default json value", "int", paramModeDefault, "7", true, `{"p": 8}`, int64(8), ""},
+		{"text nullable form empty", "text", paramModeNullable, "", false, "p=", nil, ""},
+		{"text required form empty", "text", paramModeRequired, "", false, "p=", "", ""},
+		{"text optional json empty", "text", paramModeOptional, "", true, `{"p": ""}`, "", ""},
+		{"text default form empty", "text", paramModeDefault, "x", false, "p=", "", ""},
+		{"bool form value", "bool", paramModeNullable, "", false, "p=true", true, ""},
+		{"bool json value", "bool", paramModeNullable, "", true, `{"p": false}`, false, ""},
+		{"int array form values", "int[]", paramModeNullable, "", false, "p=1&p=2", []int64{1, 2}, ""},
+		{"int array json values", "int[]", paramModeNullable, "", true, `{"p": [1, "2"]}`, []int64{1, 2}, ""},
+		{"int array json invalid element", "int[]", paramModeNullable, "", true, `{"p": [1, "a"]}`, nil, "invalid"},
+		{"text array json scalar", "text[]", paramModeNullable, "", true, `{"p": "a"}`, []string{"a"}, ""},
+		{"jsonb json object", "jsonb", paramModeNullable, "", true, `{"p": {"a": 1}}`, `{"a":1}`, ""},
+		{"jsonb json string", "jsonb", paramModeNullable, "", true, `{"p": "a"}`, `"a"`, ""},
+		{"jsonb form invalid", "jsonb", paramModeNullable, "", false, "p={a", nil, "invalid"},
+
+		// other params
+		{"unknown form param", "", paramModeNullable, "", false, "p=a&q=b", nil, "unknown"},
+		{"unknown json param", "int", paramModeNullable, "", true, `{"q": 1}`, nil, "unknown"},
+		{"session param", "", paramModeNullable, "", false, "p=a&_session_id=1", "a", ""},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			param := sqlParam{name: "p", mode: test.mode, defval: test.defval}
+			if test.ptype != "" {
+				ptype, err := paramTypeParse(test.ptype)
+				if err != nil {
+					t.Fatal(err)
+				}
+				param.ptype = ptype
+			}
+
+			var params queryParams
+			if test.json {
+				var err error
+				if params, err = queryParamsFromJSON(strings.NewReader(test.input), url.Values{}); err != nil {
+					t.Fatal(err)
+				}
+			} else {
+				form, err := url.ParseQuery(test.input)
+				if err != nil {
+					t.Fatal(err)
+				}
+				params = queryParamsFromForm(form)
+			}
+
+			res, err := paramList{param}.prepare(params, true)
+
+			var kind string
+			switch err.(type) {
+			case nil:
+			case paramsMissingError:
+				kind = "missing"
+			case *paramError:
+				kind = "invalid"
+			case paramsUnknownError:
+				kind = "unknown"
+			default:
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if kind != test.err {
+				t.Fatalf("error of %s is %q (%v), expected %q", test.input, kind, err, test.err)
+			}
+			if err != nil {
+				return
+			}
+
+			if len(res) != 1 || !reflect.DeepEqual(res[0], test.want) {
+				t.Errorf("value of %s is %#v, expected %#v", test.input, res, test.want)
+			}
+		})
+	}
+}
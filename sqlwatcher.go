@@ -0,0 +1,190 @@
+package main
+
+import (
+	"context"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+type sqlWatcher struct {
+	srvc            *pgmusql
+	watcher         *fsnotify.Watcher
+	sqlroot         string
+	delay           time.Duration
+	test            bool
+	contextCancelFn context.CancelFunc
+	wg              sync.WaitGroup
+}
+
+// create sql root watcher
+func sqlWatcherNew(ctx context.Context, srvc *pgmusql, sqlroot string, delay time.Duration, test bool) (*sqlWatcher, error) {
+	var w sqlWatcher
+	var err error
+
+	if w.watcher, err = fsnotify.NewWatcher(); err != nil {
+		return nil, err
+	}
+
+	w.srvc = srvc
+	w.sqlroot = strings.TrimSuffix(sqlroot, "/")
+	w.delay = delay
+	w.test = test
+
+	if err = w.addDir(w.sqlroot); err != nil {
+		w.watcher.Close()
+		return nil, err
+	}
+
+	var watchContext context.Context
+	watchContext, w.contextCancelFn = context.WithCancel(ctx)
+
+	// run watcher
+	w.wg.Add(1)
+	go w.watch(watchContext)
+
+	return &w, nil
+}
+
+// add directory and all subdirectories to watch list
+func (w *sqlWatcher) addDir(dir string) error {
+	return filepath.Walk(dir, func(path string, file os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if file.IsDir() {
+			return w.watcher.Add(path)
+		}
+
+		return nil
+	})
+}
+
+// watcher worker
+func (w *sqlWatcher) watch(ctx context.Context) {
+	log.Println("SQL watcher start")
+	defer w.wg.Done()
+	defer log.Println("SQL watcher stop")
+
+	// collect changes and reload them when the file system calms down
+	changes := make(map[string]bool)
+	timer := time.NewTimer(w.delay)
+	timer.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case event, ok := <-w.watcher.Events:
+			if !ok {
+				return
+			}
+			if event.Op == fsnotify.Chmod {
+				continue
+			}
+			changes[event.Name] = true
+
+			// drain fired timer, stale tick would reload before the delay
+			if !timer.Stop() {
+				select {
+				case <-timer.C:
+				default:
+				}
+			}
+			timer.Reset(w.delay)
+		case err, ok := <-w.watcher.Errors:
+			if !ok {
+				return
+			}
+			log.Println("SQL watcher error:", err)
+		case <-timer.C:
+			w.reload(ctx, changes)
+			changes = make(map[string]bool)
+		}
+	}
+}
+
+// reload changed files and swap service queries
+func (w *sqlWatcher) reload(ctx context.Context, changes map[string]bool) {
+	srvc := w.srvc
+
+	// copy current queries, in-flight requests keep using the old map
+	srvc.queriesLock.RLock()
+	queries := make(map[string]*query, len(srvc.queries))
+	for name, q := range srvc.queries {
+		queries[name] = q
+	}
+	srvc.queriesLock.RUnlock()
+
+	// collect files to parse
+	files := make(map[string]bool)
+	for path := range changes {
+		file, err := os.Stat(path)
+
+		// file or directory deleted
+		if err != nil {
+			name := path[len(w.sqlroot):]
+			for qname := range queries {
+				if strings.HasPrefix(qname, name+"/") || (isSQLFile(path) && qname == queryName(w.sqlroot, path)) {
+					log.Printf("Unload query %s\n", qname)
+					delete(queries, qname)
+				}
+			}
+			continue
+		}
+
+		// new directory, watch it and load its files
+		if file.IsDir() {
+			if err = w.addDir(path); err != nil {
+				log.Println("SQL watcher error:", err)
+			}
+			filepath.Walk(path, func(fpath string, finfo os.FileInfo, err error) error {
+				if err == nil && !finfo.IsDir() && isSQLFile(fpath) {
+					files[fpath] = true
+				}
+				return nil
+			})
+			continue
+		}
+
+		if isSQLFile(path) {
+			files[path] = true
+		}
+	}
+
+	// parse and test
+	for path := range files {
+		q := srvc.parser.loadSQLFile(w.sqlroot, path)
+		if q.err == nil && w.test {
+			srvc.queryTestScenario(ctx, q, true)
+		}
+
+		// keep previous good version live
+		if old, found := queries[q.name]; found && q.err != nil && old.err == nil {
+			log.Printf("Reload query %s failed, previous version is kept: %v\n", q.name, q.err)
+			kept := *old
+			kept.reloaderr = q.err
+			queries[q.name] = &kept
+			continue
+		}
+
+		log.Printf("Reload query %s\n", q.name)
+		queries[q.name] = q
+	}
+
+	srvc.setQueries(queries)
+}
+
+// stop watcher
+func (w *sqlWatcher) stop() {
+	w.contextCancelFn()
+	w.wg.Wait()
+	w.watcher.Close()
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+)
+
+const (
+	streamErrorTrailer = "Pgmusql-Error"
+	streamRowsTrailer  = "Pgmusql-Rows"
+	streamFlushSize    = 32 * 1024
+)
+
+var errStreamStarted = errors.New("Stream is already started")
+
+// response writer that holds output until the first row or the end of result and flushes data to the client.
+// Database errors are reported by rows iteration, so the status is sent only when rows are going.
+type streamWriter struct {
+	rw       http.ResponseWriter
+	format   resultFormat
+	started  bool
+	pending  []byte // output before start, result header of encoder
+	buffered int
+}
+
+func (w *streamWriter) Write(p []byte) (int, error) {
+	if !w.started {
+		w.pending = append(w.pending, p...)
+		return len(p), nil
+	}
+
+	n, err := w.rw.Write(p)
+	w.buffered += n
+	return n, err
+}
+
+// send status, headers and pending output
+func (w *streamWriter) start() error {
+	if w.started {
+		return nil
+	}
+	w.started = true
+
+	header := w.rw.Header()
+	header.Set("Content-Type", w.format.contentType())
+	header.Set("Trailer", streamErrorTrailer+", "+streamRowsTrailer)
+	w.rw.WriteHeader(http.StatusOK)
+
+	pending := w.pending
+	w.pending = nil
+	_, err := w.Write(pending)
+	return err
+}
+
+func (w *streamWriter) flush() {
+	if flusher, ok := w.rw.(http.Flusher); ok {
+		flusher.Flush()
+	}
+	w.buffered = 0
+}
+
+// encoder that flushes first row and then every streamFlushSize bytes
+type streamEncoder struct {
+	rowsEncoder
+	w    *streamWriter
+	rows int
+}
+
+func (e *streamEncoder) row(values []interface{}) error {
+	if err := e.w.start(); err != nil {
+		return err
+	}
+
+	if err := e.rowsEncoder.row(values); err != nil {
+		return err
+	}
+	e.rows++
+
+	if e.rows == 1 || e.w.buffered >= streamFlushSize {
+		if err := e.rowsEncoder.flush(); err != nil {
+			return err
+		}
+		e.w.flush()
+	}
+
+	return nil
+}
+
+// stream query result to client.
+// Error is returned only if nothing has been written yet. Errors that occur after the response
+// has started are written to the Pgmusql-Error trailer as json error envelope, Pgmusql-Rows trailer is set on success only.
+func (srvc *pgmusql) streamQuery(ctx context.Context, rw http.ResponseWriter, query *query, params queryParams, format resultFormat) error {
+	db, err := srvc.queryDatabase(query)
+	if err != nil {
+		return err
+	}
+
+	streamCtx, ctxCancelFnc := srvc.queryContext(ctx, query)
+	defer ctxCancelFnc()
+
+	if srvc.opts().keepalive {
+		rw.Header().Set("Connection", "Keep-Alive")
+	}
+
+	w := &streamWriter{rw: rw, format: format}
+	total, err := db.encode(streamCtx, *query, params, func() (rowsEncoder, error) {
+		if w.started {
+			return nil, errStreamStarted
+		}
+		w.pending = w.pending[:0]
+		return &streamEncoder{rowsEncoder: format.encoder(w), w: w}, nil
+	}, 0)
+
+	// context errors
+	if err != nil {
+		err = queryContextError(ctx, streamCtx, err)
+	}
+
+	if err != nil && !w.started {
+		return err
+	}
+
+	// no rows, send result header and end
+	if err == nil {
+		err = w.start()
+	}
+
+	if err != nil {
+		log.Printf("Stream query %s error: %v\n", query.name, err)
+		rw.Header().Set(streamErrorTrailer, srvc.errorString(err))
+		return nil
+	}
+
+	rw.Header().Set(streamRowsTrailer, strconv.Itoa(total))
+	return nil
+}